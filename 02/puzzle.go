@@ -7,23 +7,32 @@ import (
 	"strings"
 )
 
-type policy func(i, j int, c byte, password string) bool
+type policy func(i, j int, c rune, password string) (bool, error)
 
-func oldPolicy(i, j int, c byte, password string) bool {
+func oldPolicy(i, j int, c rune, password string) (bool, error) {
 	count := strings.Count(password, string(c))
 	if count >= i && count <= j {
-		return true
+		return true, nil
 	}
 
-	return false
+	return false, nil
 }
 
 func xor(a, b bool) bool {
 	return (a && !b) || (b && !a)
 }
 
-func newPolicy(i, j int, c byte, password string) bool {
-	return xor(password[i-1] == c, password[j-1] == c)
+// Positions are 1-based and count characters (runes), not bytes
+func newPolicy(i, j int, c rune, password string) (bool, error) {
+	runes := []rune(password)
+
+	for _, pos := range []int{i, j} {
+		if pos < 1 || pos > len(runes) {
+			return false, fmt.Errorf("position %d out of range for password %q (length %d)", pos, password, len(runes))
+		}
+	}
+
+	return xor(runes[i-1] == c, runes[j-1] == c), nil
 }
 
 func run() error {
@@ -54,17 +63,22 @@ func run() error {
 		line := scanner.Text()
 
 		var i, j int
-		var r byte
+		var r rune
 		var password string
 
 		n, err := fmt.Sscanf(line, "%d-%d %c: %s", &i, &j, &r, &password)
 		if n != 4 {
 			return fmt.Errorf("couldn't parse line: %s", line)
 		} else if err != nil {
-			return nil
+			return err
+		}
+
+		valid, err := policyFunc(i, j, r, password)
+		if err != nil {
+			return err
 		}
 
-		if policyFunc(i, j, r, password) {
+		if valid {
 			numValid++
 		}
 
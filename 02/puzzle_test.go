@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func policyTest(t *testing.T, p policy, i, j int, c rune, password string, expected bool) {
+	valid, err := p(i, j, c, password)
+	if err != nil {
+		t.Fatal(err)
+	} else if valid != expected {
+		t.Errorf("%d-%d %c: %s: expected %v got %v", i, j, c, password, expected, valid)
+	}
+}
+
+func TestOldPolicy(t *testing.T) {
+	policyTest(t, oldPolicy, 1, 3, 'a', "abcde", true)
+	policyTest(t, oldPolicy, 1, 3, 'b', "cdefg", false)
+	policyTest(t, oldPolicy, 2, 9, 'c', "ccccccccc", true)
+
+	policyTest(t, oldPolicy, 2, 2, 'é', "éabé", true)
+	policyTest(t, oldPolicy, 1, 1, 'é', "eéé", false)
+	policyTest(t, oldPolicy, 1, 2, '☃', "snow☃man", true)
+}
+
+func TestNewPolicy(t *testing.T) {
+	policyTest(t, newPolicy, 1, 3, 'a', "abcde", true)
+	policyTest(t, newPolicy, 1, 3, 'b', "cdefg", false)
+	policyTest(t, newPolicy, 2, 9, 'c', "ccccccccc", false)
+
+	// Multi-byte characters must count as a single position
+	policyTest(t, newPolicy, 1, 3, 'é', "ééé", false)
+	policyTest(t, newPolicy, 2, 3, 'c', "écd", true)
+	policyTest(t, newPolicy, 3, 4, '☃', "日本☃x", true)
+	policyTest(t, newPolicy, 1, 2, 'ß', "aß", true)
+}
+
+func TestNewPolicyOutOfRange(t *testing.T) {
+	// "éé" is 4 bytes but only 2 characters
+	if _, err := newPolicy(1, 3, 'é', "éé"); err == nil {
+		t.Errorf("expected error for position beyond password length")
+	}
+
+	if _, err := newPolicy(0, 1, 'a', "abc"); err == nil {
+		t.Errorf("expected error for position 0")
+	}
+}
+
+func TestParseRune(t *testing.T) {
+	var i, j int
+	var r rune
+	var password string
+
+	n, err := fmt.Sscanf("1-3 é: ééa", "%d-%d %c: %s", &i, &j, &r, &password)
+	if err != nil {
+		t.Fatal(err)
+	} else if n != 4 {
+		t.Fatalf("expected 4 items, got %d", n)
+	}
+
+	if r != 'é' {
+		t.Errorf("expected 'é' got %q", r)
+	}
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"strings"
+	"sync"
 )
 
 type Slope struct {
@@ -15,64 +17,294 @@ func (s Slope) String() string {
 	return fmt.Sprintf("[%d, %d]", s.Right, s.Down)
 }
 
-func run() error {
-	if len(os.Args) < 3 {
-		return fmt.Errorf("Usage: %s INPUT right,down...", os.Args[0])
+// Forest is the toboggan map. It repeats infinitely to the right, so all
+// x coordinates wrap. It's never modified after loading, so it's safe to
+// query from multiple goroutines.
+type Forest struct {
+	Width, Height int
+	trees         [][]bool
+}
+
+func LoadForest(r io.Reader) (*Forest, error) {
+	f := &Forest{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+
+		if f.Width == 0 {
+			f.Width = len(line)
+		} else if len(line) != f.Width {
+			return nil, fmt.Errorf("line %d has width %d, expected %d", f.Height+1, len(line), f.Width)
+		}
+
+		row := make([]bool, len(line))
+		for i, c := range line {
+			switch c {
+			case '#':
+				row[i] = true
+			case '.':
+				row[i] = false
+			default:
+				return nil, fmt.Errorf("unexpected character '%c' on line %d", c, f.Height+1)
+			}
+		}
+
+		f.trees = append(f.trees, row)
+		f.Height++
 	}
 
-	f, err := os.Open(os.Args[1])
-	if err != nil {
-		return err
+	if err := scanner.Err(); err != nil {
+		return nil, err
 	}
-	defer f.Close()
 
-	slopes := make([]Slope, 0)
+	if f.Height == 0 {
+		return nil, fmt.Errorf("empty map")
+	}
 
-	for _, a := range os.Args[2:] {
-		s := Slope{}
+	return f, nil
+}
 
-		n, err := fmt.Sscanf(a, "%d,%d", &s.Right, &s.Down)
-		if n != 2 {
-			return fmt.Errorf("couldn't parse argument as right,down pair: %s", a)
-		} else if err != nil {
-			return err
+func (f *Forest) Tree(x, y int) bool {
+	x %= f.Width
+	if x < 0 {
+		x += f.Width
+	}
+
+	return f.trees[y][x]
+}
+
+// TreesOnSlope counts the trees hit going down the slope from the top
+// left. The route must go down, so it's 0 if s.Down isn't positive.
+func (f *Forest) TreesOnSlope(s Slope) int {
+	if s.Down <= 0 {
+		return 0
+	}
+
+	numTrees := 0
+	for x, y := 0, 0; y < f.Height; x, y = x+s.Right, y+s.Down {
+		if f.Tree(x, y) {
+			numTrees++
 		}
+	}
 
-		slopes = append(slopes, s)
+	return numTrees
+}
+
+type SlopeResult struct {
+	Slope
+	Trees int
+}
+
+// Search evaluates every slope with 0 <= Right <= maxRight and
+// 1 <= Down <= maxDown, returning all the slopes which share the fewest
+// trees and all those which share the most.
+func (f *Forest) Search(maxRight, maxDown int) (fewest, most []SlopeResult) {
+	for down := 1; down <= maxDown; down++ {
+		for right := 0; right <= maxRight; right++ {
+			r := SlopeResult{Slope{right, down}, 0}
+			r.Trees = f.TreesOnSlope(r.Slope)
+
+			if len(fewest) == 0 || r.Trees < fewest[0].Trees {
+				fewest = []SlopeResult{r}
+			} else if r.Trees == fewest[0].Trees {
+				fewest = append(fewest, r)
+			}
+
+			if len(most) == 0 || r.Trees > most[0].Trees {
+				most = []SlopeResult{r}
+			} else if r.Trees == most[0].Trees {
+				most = append(most, r)
+			}
+		}
 	}
 
-	product := 1
+	return fewest, most
+}
 
-	for _, s := range slopes {
-		f.Seek(0, 0)
-		scanner := bufio.NewScanner(f)
+func floorDiv(a, b int) int {
+	if a < 0 {
+		return -((-a + b - 1) / b)
+	}
+	return a / b
+}
 
-		numTrees := 0
-		x := 0
-		skip := 0 // We always process the first line
+// Render draws the map with the route for slope s overlaid, using 'O' for
+// open squares and 'X' for trees which the route lands on. The map is
+// repeated horizontally as many times as needed to show the whole route.
+func (f *Forest) Render(w io.Writer, s Slope) error {
+	if s.Down <= 0 {
+		return fmt.Errorf("down must be positive: %v", s)
+	}
 
-		for scanner.Scan() {
-			line := strings.TrimSpace(scanner.Text())
+	route := make(map[[2]int]bool)
+	minX, maxX := 0, 0
+	for x, y := 0, 0; y < f.Height; x, y = x+s.Right, y+s.Down {
+		route[[2]int{x, y}] = true
+		if x < minX {
+			minX = x
+		}
+		if x > maxX {
+			maxX = x
+		}
+	}
+
+	startX := floorDiv(minX, f.Width) * f.Width
+	endX := (floorDiv(maxX, f.Width) + 1) * f.Width
 
-			if skip == 0 {
-				tree := (line[x%len(line)] == '#')
+	bw := bufio.NewWriter(w)
+	for y := 0; y < f.Height; y++ {
+		for x := startX; x < endX; x++ {
+			tree := f.Tree(x, y)
+
+			c := byte('.')
+			if route[[2]int{x, y}] {
+				c = 'O'
 				if tree {
-					numTrees++
+					c = 'X'
 				}
-				x += s.Right
-				skip = s.Down
+			} else if tree {
+				c = '#'
 			}
 
-			skip--
+			bw.WriteByte(c)
 		}
+		bw.WriteByte('\n')
+	}
+
+	return bw.Flush()
+}
+
+func parseSlope(a string) (Slope, error) {
+	s := Slope{}
 
-		if err := scanner.Err(); err != nil {
+	n, err := fmt.Sscanf(a, "%d,%d", &s.Right, &s.Down)
+	if n != 2 {
+		return s, fmt.Errorf("couldn't parse argument as right,down pair: %s", a)
+	} else if err != nil {
+		return s, err
+	}
+
+	if s.Down < 1 {
+		return s, fmt.Errorf("down must be positive: %s", a)
+	}
+
+	return s, nil
+}
+
+func loadInput(filename string) (*Forest, error) {
+	if filename == "-" {
+		return LoadForest(os.Stdin)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return LoadForest(f)
+}
+
+func runSearch(forest *Forest, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: %s INPUT|- search maxright,maxdown", os.Args[0])
+	}
+
+	bounds, err := parseSlope(args[0])
+	if err != nil {
+		return err
+	}
+
+	if bounds.Right < 0 {
+		return fmt.Errorf("maxright must not be negative: %s", args[0])
+	}
+
+	fewest, most := forest.Search(bounds.Right, bounds.Down)
+
+	fmt.Println("Fewest trees:", fewest[0].Trees)
+	for _, r := range fewest {
+		fmt.Println("  ", r.Slope)
+	}
+
+	fmt.Println("Most trees:", most[0].Trees)
+	for _, r := range most {
+		fmt.Println("  ", r.Slope)
+	}
+
+	return nil
+}
+
+func runRender(forest *Forest, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: %s INPUT|- render right,down", os.Args[0])
+	}
+
+	s, err := parseSlope(args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := forest.Render(os.Stdout, s); err != nil {
+		return err
+	}
+
+	fmt.Println(s, forest.TreesOnSlope(s))
+
+	return nil
+}
+
+func run() error {
+	if len(os.Args) < 3 {
+		return fmt.Errorf("Usage: %s INPUT|- right,down...\n"+
+			"       %s INPUT|- search maxright,maxdown\n"+
+			"       %s INPUT|- render right,down", os.Args[0], os.Args[0], os.Args[0])
+	}
+
+	forest, err := loadInput(os.Args[1])
+	if err != nil {
+		return err
+	}
+
+	switch os.Args[2] {
+	case "search":
+		return runSearch(forest, os.Args[3:])
+	case "render":
+		return runRender(forest, os.Args[3:])
+	}
+
+	slopes := make([]Slope, 0)
+
+	for _, a := range os.Args[2:] {
+		s, err := parseSlope(a)
+		if err != nil {
 			return err
 		}
 
-		fmt.Println(s, numTrees)
+		slopes = append(slopes, s)
+	}
+
+	results := make([]int, len(slopes))
+
+	var wg sync.WaitGroup
+	for i, s := range slopes {
+		wg.Add(1)
+		go func(i int, s Slope) {
+			defer wg.Done()
+			results[i] = forest.TreesOnSlope(s)
+		}(i, s)
+	}
+	wg.Wait()
+
+	product := 1
+
+	for i, s := range slopes {
+		fmt.Println(s, results[i])
 
-		product *= numTrees
+		product *= results[i]
 	}
 
 	fmt.Println(product)
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+const example = `..##.......
+#...#...#..
+.#....#..#.
+..#.#...#.#
+.#...##..#.
+..#.##.....
+.#.#.#....#
+.#........#
+#.##...#...
+#...##....#
+.#..#...#.#
+`
+
+func loadExample(t *testing.T) *Forest {
+	forest, err := LoadForest(strings.NewReader(example))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return forest
+}
+
+func TestLoadForest(t *testing.T) {
+	forest := loadExample(t)
+	if forest.Width != 11 || forest.Height != 11 {
+		t.Errorf("expected 11x11, got %dx%d", forest.Width, forest.Height)
+	}
+
+	if !forest.Tree(2, 0) || forest.Tree(0, 0) || !forest.Tree(13, 0) || !forest.Tree(-9, 0) {
+		t.Errorf("unexpected trees on the first row")
+	}
+
+	// Blank lines and surrounding whitespace are ignored
+	forest, err := LoadForest(strings.NewReader("\r\n  .#\r\n\n#.\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forest.Width != 2 || forest.Height != 2 || !forest.Tree(1, 0) || !forest.Tree(0, 1) {
+		t.Errorf("unexpected forest: %+v", forest)
+	}
+
+	bad := []string{
+		"",
+		"..#\n..\n",
+		"..#\n..#.\n",
+		"..#\n.O#\n",
+	}
+
+	for _, src := range bad {
+		if _, err := LoadForest(strings.NewReader(src)); err == nil {
+			t.Errorf("%q: expected error", src)
+		}
+	}
+}
+
+func TestTreesOnSlope(t *testing.T) {
+	forest := loadExample(t)
+
+	tests := []struct {
+		s     Slope
+		trees int
+	}{
+		{Slope{1, 1}, 2},
+		{Slope{3, 1}, 7},
+		{Slope{5, 1}, 3},
+		{Slope{7, 1}, 4},
+		{Slope{1, 2}, 2},
+	}
+
+	product := 1
+	for _, test := range tests {
+		trees := forest.TreesOnSlope(test.s)
+		if trees != test.trees {
+			t.Errorf("%v: expected %d got %d", test.s, test.trees, trees)
+		}
+		product *= trees
+	}
+
+	if product != 336 {
+		t.Errorf("expected product 336 got %d", product)
+	}
+
+	// These would never reach the bottom
+	for _, s := range []Slope{{3, 0}, {1, -1}} {
+		if trees := forest.TreesOnSlope(s); trees != 0 {
+			t.Errorf("%v: expected 0 got %d", s, trees)
+		}
+	}
+}
+
+func TestLoadInputStdin(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+
+	go func() {
+		w.WriteString(example)
+		w.Close()
+	}()
+
+	forest, err := loadInput("-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if trees := forest.TreesOnSlope(Slope{3, 1}); trees != 7 {
+		t.Errorf("expected 7 got %d", trees)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	forest := loadExample(t)
+
+	fewest, most := forest.Search(3, 2)
+
+	// Ties are all returned, in the order searched
+	expectedFewest := []SlopeResult{{Slope{2, 1}, 1}, {Slope{0, 2}, 1}, {Slope{2, 2}, 1}}
+	expectedMost := []SlopeResult{{Slope{3, 1}, 7}}
+
+	check := func(name string, got, expected []SlopeResult) {
+		if len(got) != len(expected) {
+			t.Fatalf("%s: expected %v got %v", name, expected, got)
+		}
+		for i := range expected {
+			if got[i] != expected[i] {
+				t.Errorf("%s: expected %v got %v", name, expected, got)
+			}
+		}
+	}
+
+	check("fewest", fewest, expectedFewest)
+	check("most", most, expectedMost)
+}
+
+func TestRender(t *testing.T) {
+	forest, err := LoadForest(strings.NewReader("#..\n.#.\n..#\n#..\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		s        Slope
+		expected string
+	}{
+		{Slope{1, 1}, "X..#..\n.X..#.\n..X..#\n#..X..\n"},
+		// The map is repeated to the left, starting on a whole tile
+		{Slope{-1, 1}, "#..X..\n.#O.#.\n.O#..#\nX..#..\n"},
+		{Slope{0, 2}, "X..\n.#.\nO.#\n#..\n"},
+	}
+
+	for _, test := range tests {
+		var sb strings.Builder
+		if err := forest.Render(&sb, test.s); err != nil {
+			t.Fatal(err)
+		}
+
+		if sb.String() != test.expected {
+			t.Errorf("%v: expected:\n%s\ngot:\n%s", test.s, test.expected, sb.String())
+		}
+	}
+
+	if err := forest.Render(&strings.Builder{}, Slope{1, 0}); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -3,77 +3,220 @@ package main
 import (
 	"bufio"
 	"bytes"
+	_ "embed"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"unicode"
 )
 
-func ScanPassport(data []byte, atEOF bool) (advance int, token []byte, err error) {
-	if atEOF && len(data) == 0 {
-		return 0, nil, nil
+// PassportScanner splits a batch file into passport records, which are
+// separated by blank lines. It's similar to a bufio.Scanner, but there's no
+// limit on the size of a record, and each byte of input is only looked at
+// once.
+//
+// Lines may end with "\n", "\r\n" or "\r", and lines containing only
+// whitespace count as blank.
+type PassportScanner struct {
+	r      *bufio.Reader
+	line   []byte
+	record []byte
+	err    error
+}
+
+func NewPassportScanner(r io.Reader) *PassportScanner {
+	return &PassportScanner{
+		r: bufio.NewReader(r),
 	}
+}
+
+// readLine reads the next line, without its line ending, into s.line.
+// It returns io.EOF only if there was nothing left to read.
+func (s *PassportScanner) readLine() error {
+	s.line = s.line[:0]
+
+	for {
+		b, err := s.r.ReadByte()
+		if err == io.EOF && len(s.line) > 0 {
+			return nil
+		} else if err != nil {
+			return err
+		}
 
-	if i := strings.Index(string(data), "\n\n"); i >= 0 {
-		// Data contains a blank line
-		// Note: my input.txt uses \n newlines, this won't work for
-		// Windows-style line endings
-		return i + 1, bytes.TrimSpace(data[0 : i+1]), nil
+		switch b {
+		case '\r':
+			if next, err := s.r.Peek(1); err == nil && next[0] == '\n' {
+				s.r.ReadByte()
+			}
+			return nil
+		case '\n':
+			return nil
+		default:
+			s.line = append(s.line, b)
+		}
 	}
+}
+
+// Scan advances to the next record, which is then available via Bytes. It
+// returns false at the end of the input or on error.
+func (s *PassportScanner) Scan() bool {
+	s.record = s.record[:0]
 
-	if atEOF {
-		// Return what we've got
-		return len(data), bytes.TrimSpace(data), nil
+	if s.err != nil {
+		return false
 	}
 
-	// Request more data.
-	return 0, nil, nil
+	for {
+		err := s.readLine()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			s.err = err
+			break
+		}
+
+		line := bytes.TrimSpace(s.line)
+		if len(line) == 0 {
+			if len(s.record) > 0 {
+				return true
+			}
+			// Skip leading and repeated blank lines
+			continue
+		}
+
+		if len(s.record) > 0 {
+			s.record = append(s.record, '\n')
+		}
+		s.record = append(s.record, line...)
+	}
+
+	return len(s.record) > 0
+}
+
+// Bytes returns the current record, with line endings normalised to "\n"
+// and leading and trailing whitespace removed from each line. The
+// underlying array may be overwritten by the next call to Scan.
+func (s *PassportScanner) Bytes() []byte {
+	return s.record
+}
+
+// Err returns the first non-EOF error encountered
+func (s *PassportScanner) Err() error {
+	return s.err
 }
 
 type Passport struct {
 	Fields map[string]string
 }
 
+// Keys returns the passport's field names in sorted order
+func (p *Passport) Keys() []string {
+	keys := make([]string, 0, len(p.Fields))
+	for k := range p.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
 func (p *Passport) String() string {
-	return fmt.Sprintf("byr: %s, iyr: %s, eyr: %s hgt: %s, hcl: %s, ecl: %s, pid: %s",
-		p.Fields["byr"],
-		p.Fields["iyr"],
-		p.Fields["eyr"],
-		p.Fields["hgt"],
-		p.Fields["hcl"],
-		p.Fields["ecl"],
-		p.Fields["pid"])
-}
-
-type fieldValidFunc func(val string) bool
-type policy map[string]fieldValidFunc
-
-func (p *Passport) Valid(rules policy) bool {
-	requiredFields := []string{
-		"byr",
-		"iyr",
-		"eyr",
-		"hgt",
-		"hcl",
-		"ecl",
-		"pid",
-	}
-
-	for _, f := range requiredFields {
-		val, ok := p.Fields[f]
-		if !ok {
-			return false
+	fields := make([]string, 0, len(p.Fields))
+	for _, k := range p.Keys() {
+		fields = append(fields, fmt.Sprintf("%s: %s", k, p.Fields[k]))
+	}
+
+	return strings.Join(fields, ", ")
+}
+
+// MarshalText produces the batch file representation of the passport, with
+// the fields in sorted order on a single line.
+func (p Passport) MarshalText() ([]byte, error) {
+	var buf bytes.Buffer
+	for i, k := range p.Keys() {
+		v := p.Fields[k]
+		// UnmarshalText splits fields with bytes.Fields, so any space
+		// would split them here too
+		if len(k) == 0 || strings.Contains(k, ":") || strings.IndexFunc(k, unicode.IsSpace) >= 0 || strings.IndexFunc(v, unicode.IsSpace) >= 0 {
+			return nil, fmt.Errorf("can't represent field %q: %q as text", k, v)
+		}
+
+		if i > 0 {
+			buf.WriteByte(' ')
 		}
+		buf.WriteString(k)
+		buf.WriteByte(':')
+		buf.WriteString(v)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (p Passport) MarshalJSON() ([]byte, error) {
+	if p.Fields == nil {
+		return []byte("{}"), nil
+	}
+
+	return json.Marshal(p.Fields)
+}
+
+func (p *Passport) UnmarshalJSON(data []byte) error {
+	fields := make(map[string]string)
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	p.Fields = fields
+
+	return nil
+}
+
+// FieldFailure describes a single schema rule which a passport field broke
+type FieldFailure struct {
+	Field  string
+	Rule   string
+	Reason string
+}
+
+func (f FieldFailure) String() string {
+	return fmt.Sprintf("%s: %s: %s", f.Field, f.Rule, f.Reason)
+}
+
+// Valid checks the passport against schema s, returning whether it's valid
+// and every rule which failed, ordered by field name.
+func (p *Passport) Valid(s *Schema) (bool, []FieldFailure) {
+	names := make([]string, 0, len(s.Fields))
+	for name := range s.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var failures []FieldFailure
+	for _, name := range names {
+		fs := s.Fields[name]
 
-		if vf, ok := rules[f]; ok {
-			if !vf(val) {
-				return false
+		val, ok := p.Fields[name]
+		if !ok {
+			if fs.Required {
+				failures = append(failures, FieldFailure{name, "required", "missing"})
 			}
+			continue
+		}
+
+		for _, f := range fs.check(val) {
+			f.Field = name
+			failures = append(failures, f)
 		}
 	}
 
-	return true
+	return len(failures) == 0, failures
 }
 
 func (p *Passport) UnmarshalText(text []byte) error {
@@ -82,140 +225,368 @@ func (p *Passport) UnmarshalText(text []byte) error {
 		p.Fields = make(map[string]string)
 	}
 
-	scanner := bufio.NewScanner(bytes.NewBuffer(text))
-	scanner.Split(bufio.ScanWords)
-	for scanner.Scan() {
-		text := scanner.Text()
-
-		kv := strings.Split(text, ":")
+	for _, field := range bytes.Fields(text) {
+		kv := strings.SplitN(string(field), ":", 2)
 		if len(kv) != 2 {
-			return fmt.Errorf("couldn't parse as key:value: %s", text)
+			return fmt.Errorf("couldn't parse as key:value: %s", field)
 		}
 
 		p.Fields[kv[0]] = kv[1]
 	}
 
-	if err := scanner.Err(); err != nil {
-		return err
+	return nil
+}
+
+// Range is an inclusive range. Either end may be omitted.
+type Range struct {
+	Min *int `json:"min"`
+	Max *int `json:"max"`
+}
+
+func (r Range) Contains(v int) bool {
+	return (r.Min == nil || v >= *r.Min) && (r.Max == nil || v <= *r.Max)
+}
+
+func (r Range) String() string {
+	min, max := "", ""
+	if r.Min != nil {
+		min = strconv.Itoa(*r.Min)
+	}
+	if r.Max != nil {
+		max = strconv.Itoa(*r.Max)
 	}
+	return fmt.Sprintf("[%s, %s]", min, max)
+}
 
-	return nil
+const (
+	TypeAny        = ""
+	TypeYear       = "year"
+	TypeNumber     = "number"
+	TypeNumberUnit = "number+unit"
+	TypeRegex      = "regex"
+	TypeEnum       = "enum"
+)
+
+// FieldSchema describes the rules for a single passport field.
+// Which of the other members are used depends on Type:
+//
+//	""            any value is accepted
+//	"year"        four digits, within Range
+//	"number"      an integer, within Range
+//	"number+unit" an integer followed by a key of Units, within its range
+//	"regex"       matches Pattern
+//	"enum"        one of Values
+type FieldSchema struct {
+	Required bool   `json:"required"`
+	Type     string `json:"type"`
+	Range
+	Units   map[string]Range `json:"units"`
+	Pattern string           `json:"pattern"`
+	Values  []string         `json:"values"`
+
+	re *regexp.Regexp
 }
 
-var yearRE *regexp.Regexp = regexp.MustCompile("[0-9]{4}")
+type Schema struct {
+	Fields map[string]*FieldSchema `json:"fields"`
+}
 
-func rangeYearField(val string, min, max int) bool {
-	if !yearRE.MatchString(val) {
-		return false
+func LoadSchema(r io.Reader) (*Schema, error) {
+	var s Schema
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&s); err != nil {
+		return nil, err
 	}
 
-	i, err := strconv.Atoi(val)
-	if err != nil {
-		return false
+	for name, fs := range s.Fields {
+		if fs == nil {
+			return nil, fmt.Errorf("field %s: missing definition", name)
+		}
+
+		if err := fs.compile(); err != nil {
+			return nil, fmt.Errorf("field %s: %v", name, err)
+		}
 	}
 
-	return i >= min && i <= max
+	return &s, nil
 }
 
-func heightValid(val string) bool {
-	var num int
-	var unit string
+func LoadSchemaFile(filename string) (*Schema, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
 
-	n, err := fmt.Sscanf(val, "%d%s", &num, &unit)
-	if n != 2 {
-		return false
-	} else if err != nil {
-		return false
+	s, err := LoadSchema(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
 	}
 
-	switch unit {
-	case "cm":
-		return num >= 150 && num <= 193
-	case "in":
-		return num >= 59 && num <= 76
+	return s, nil
+}
+
+func (fs *FieldSchema) compile() error {
+	switch fs.Type {
+	case TypeAny, TypeYear, TypeNumber:
+		return nil
+	case TypeNumberUnit:
+		if len(fs.Units) == 0 {
+			return fmt.Errorf("type %s needs at least one unit", fs.Type)
+		}
+		return nil
+	case TypeRegex:
+		re, err := regexp.Compile(fs.Pattern)
+		if err != nil {
+			return err
+		}
+		fs.re = re
+		return nil
+	case TypeEnum:
+		if len(fs.Values) == 0 {
+			return fmt.Errorf("type %s needs at least one value", fs.Type)
+		}
+		return nil
 	default:
-		return false
+		return fmt.Errorf("unknown type: %s", fs.Type)
 	}
+}
+
+var yearRE *regexp.Regexp = regexp.MustCompile("^[0-9]{4}$")
+var numberUnitRE *regexp.Regexp = regexp.MustCompile("^(-?[0-9]+)([^0-9]*)$")
 
-	return false
+func (fs *FieldSchema) checkRange(r Range, num int) []FieldFailure {
+	if !r.Contains(num) {
+		return []FieldFailure{{Rule: "range", Reason: fmt.Sprintf("%d not in %v", num, r)}}
+	}
+	return nil
 }
 
-var colorRE *regexp.Regexp = regexp.MustCompile("^#[0-9a-f]{6}$")
+// check returns the rules which val fails. The Field member of each
+// FieldFailure is left for the caller to fill in.
+func (fs *FieldSchema) check(val string) []FieldFailure {
+	switch fs.Type {
+	case TypeYear:
+		if !yearRE.MatchString(val) {
+			return []FieldFailure{{Rule: "year", Reason: fmt.Sprintf("%q is not a 4-digit year", val)}}
+		}
+		num, _ := strconv.Atoi(val)
+		return fs.checkRange(fs.Range, num)
+	case TypeNumber:
+		num, err := strconv.Atoi(val)
+		if err != nil {
+			return []FieldFailure{{Rule: "number", Reason: fmt.Sprintf("%q is not a number", val)}}
+		}
+		return fs.checkRange(fs.Range, num)
+	case TypeNumberUnit:
+		m := numberUnitRE.FindStringSubmatch(val)
+		if m == nil {
+			return []FieldFailure{{Rule: "number+unit", Reason: fmt.Sprintf("%q is not a number with a unit", val)}}
+		}
+		num, err := strconv.Atoi(m[1])
+		if err != nil {
+			return []FieldFailure{{Rule: "number+unit", Reason: err.Error()}}
+		}
+		r, ok := fs.Units[m[2]]
+		if !ok {
+			return []FieldFailure{{Rule: "unit", Reason: fmt.Sprintf("unknown unit %q", m[2])}}
+		}
+		return fs.checkRange(r, num)
+	case TypeRegex:
+		if !fs.re.MatchString(val) {
+			return []FieldFailure{{Rule: "regex", Reason: fmt.Sprintf("%q doesn't match %s", val, fs.Pattern)}}
+		}
+	case TypeEnum:
+		for _, v := range fs.Values {
+			if val == v {
+				return nil
+			}
+		}
+		return []FieldFailure{{Rule: "enum", Reason: fmt.Sprintf("%q not one of %v", val, fs.Values)}}
+	}
 
-func colorValid(val string) bool {
-	return colorRE.MatchString(val)
+	return nil
 }
 
-var pidRE *regexp.Regexp = regexp.MustCompile("^[0-9]{9}$")
+// The built-in schemas are compiled in, so they work from any directory
+var (
+	//go:embed strict.json
+	strictSchema []byte
+	//go:embed relaxed.json
+	relaxedSchema []byte
+)
 
-func pidValid(val string) bool {
-	return pidRE.MatchString(val)
+var builtinSchemas = map[string][]byte{
+	"strict":  strictSchema,
+	"relaxed": relaxedSchema,
 }
 
-func listValid(val string, vals []string) bool {
-	for _, v := range vals {
-		if val == v {
-			return true
+// loadSchemaArg loads a schema file. "strict" is shorthand for
+// "strict.json", and if there's no such file, the built-in copy is used.
+func loadSchemaArg(arg string) (*Schema, error) {
+	if _, err := os.Stat(arg); os.IsNotExist(err) && filepath.Ext(arg) == "" {
+		if _, err := os.Stat(arg + ".json"); err == nil {
+			return LoadSchemaFile(arg + ".json")
+		}
+
+		if data, ok := builtinSchemas[arg]; ok {
+			return LoadSchema(bytes.NewReader(data))
 		}
 	}
-	return false
+
+	return LoadSchemaFile(arg)
 }
 
-func alwaysValid(val string) bool {
-	return true
+func doPassports(filename string, do func(ppt *Passport) error) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := NewPassportScanner(f)
+	for scanner.Scan() {
+		var ppt Passport
+
+		err := (&ppt).UnmarshalText(scanner.Bytes())
+		if err != nil {
+			return err
+		}
+
+		if err := do(&ppt); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
 }
 
-var strictRules policy = map[string]fieldValidFunc{
-	"byr": func(val string) bool { return rangeYearField(val, 1920, 2002) },
-	"iyr": func(val string) bool { return rangeYearField(val, 2010, 2020) },
-	"eyr": func(val string) bool { return rangeYearField(val, 2020, 2030) },
-	"hgt": heightValid,
-	"hcl": colorValid,
-	"ecl": func(val string) bool {
-		return listValid(val, []string{"amb", "blu", "brn", "gry", "grn", "hzl", "oth"})
-	},
-	"pid": pidValid,
+type exportRecord struct {
+	Passport Passport `json:"passport"`
+	Valid    bool     `json:"valid"`
+	Failures []string `json:"failures"`
 }
 
-func run() error {
-	if len(os.Args) != 3 {
-		return fmt.Errorf("Usage: %s RULES INPUT", os.Args[0])
+func failureStrings(failures []FieldFailure) []string {
+	strs := make([]string, 0, len(failures))
+	for _, f := range failures {
+		strs = append(strs, f.String())
 	}
 
-	policies := map[string]policy{
-		"relaxed": nil,
-		"strict":  strictRules,
+	return strs
+}
+
+func exportJSONLines(w io.Writer, schema *Schema, filename string) error {
+	enc := json.NewEncoder(w)
+
+	return doPassports(filename, func(ppt *Passport) error {
+		ok, failures := ppt.Valid(schema)
+
+		return enc.Encode(exportRecord{*ppt, ok, failureStrings(failures)})
+	})
+}
+
+// exportCSV writes one column for every field name seen anywhere in the
+// batch, followed by the "valid" and "failures" columns. Missing fields are
+// left empty.
+func exportCSV(w io.Writer, schema *Schema, filename string) error {
+	var passports []*Passport
+	keySet := make(map[string]bool)
+
+	if err := doPassports(filename, func(ppt *Passport) error {
+		passports = append(passports, ppt)
+		for k := range ppt.Fields {
+			keySet[k] = true
+		}
+		return nil
+	}); err != nil {
+		return err
 	}
 
-	policy, ok := policies[os.Args[1]]
-	if !ok {
-		return fmt.Errorf("unknown rules: %s", os.Args[1])
+	keys := make([]string, 0, len(keySet))
+	for k := range keySet {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
 
-	f, err := os.Open(os.Args[2])
-	if err != nil {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(append(keys, "valid", "failures")); err != nil {
 		return err
 	}
-	defer f.Close()
 
-	valid := 0
+	for _, ppt := range passports {
+		ok, failures := ppt.Valid(schema)
 
-	scanner := bufio.NewScanner(f)
-	scanner.Split(ScanPassport)
-	for scanner.Scan() {
-		var ppt Passport
+		record := make([]string, 0, len(keys)+2)
+		for _, k := range keys {
+			record = append(record, ppt.Fields[k])
+		}
+		record = append(record, strconv.FormatBool(ok), strings.Join(failureStrings(failures), "; "))
 
-		err := (&ppt).UnmarshalText(scanner.Bytes())
-		if err != nil {
+		if err := cw.Write(record); err != nil {
 			return err
 		}
+	}
+
+	cw.Flush()
+
+	return cw.Error()
+}
+
+func runExport(args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("Usage: %s export jsonl|csv SCHEMA INPUT", os.Args[0])
+	}
 
-		if ppt.Valid(policy) {
+	schema, err := loadSchemaArg(args[1])
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "jsonl":
+		return exportJSONLines(os.Stdout, schema, args[2])
+	case "csv":
+		return exportCSV(os.Stdout, schema, args[2])
+	default:
+		return fmt.Errorf("unknown export format: %s", args[0])
+	}
+}
+
+func run() error {
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		return runExport(os.Args[2:])
+	}
+
+	if len(os.Args) < 3 {
+		return fmt.Errorf("Usage: %s SCHEMA INPUT [VERBOSE]\n"+
+			"       %s export jsonl|csv SCHEMA INPUT", os.Args[0], os.Args[0])
+	}
+
+	schema, err := loadSchemaArg(os.Args[1])
+	if err != nil {
+		return err
+	}
+
+	verbose := len(os.Args) > 3
+
+	valid := 0
+
+	if err := doPassports(os.Args[2], func(ppt *Passport) error {
+		ok, failures := ppt.Valid(schema)
+		if ok {
 			valid++
+		} else if verbose {
+			fmt.Println(ppt.String())
+			for _, f := range failures {
+				fmt.Println("  ", f)
+			}
 		}
-	}
 
-	if err := scanner.Err(); err != nil {
+		return nil
+	}); err != nil {
 		return err
 	}
 
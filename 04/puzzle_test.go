@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func scanTest(t *testing.T, input string, expected []string) {
+	var records []string
+
+	scanner := NewPassportScanner(strings.NewReader(input))
+	for scanner.Scan() {
+		records = append(records, string(scanner.Bytes()))
+	}
+
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != len(expected) {
+		t.Fatalf("%q: expected %d records got %d: %q", input, len(expected), len(records), records)
+	}
+
+	for i := range expected {
+		if records[i] != expected[i] {
+			t.Errorf("%q: record %d: expected %q got %q", input, i, expected[i], records[i])
+		}
+	}
+}
+
+func TestScanPassportLF(t *testing.T) {
+	scanTest(t, "a:1 b:2\nc:3\n\nd:4\n", []string{"a:1 b:2\nc:3", "d:4"})
+	scanTest(t, "a:1\n\n\n\nb:2", []string{"a:1", "b:2"})
+	scanTest(t, "\n\na:1\n\n", []string{"a:1"})
+	scanTest(t, "", nil)
+	scanTest(t, "\n\n\n", nil)
+}
+
+func TestScanPassportCRLF(t *testing.T) {
+	scanTest(t, "a:1 b:2\r\nc:3\r\n\r\nd:4\r\n", []string{"a:1 b:2\nc:3", "d:4"})
+	scanTest(t, "a:1\r\n\r\n\r\nb:2", []string{"a:1", "b:2"})
+
+	// Bare CR line endings
+	scanTest(t, "a:1\rc:3\r\rd:4", []string{"a:1\nc:3", "d:4"})
+
+	// Mixed
+	scanTest(t, "a:1\r\nb:2\n\r\nc:3\r\rd:4\n", []string{"a:1\nb:2", "c:3", "d:4"})
+}
+
+func TestScanPassportWhitespaceSeparator(t *testing.T) {
+	scanTest(t, "a:1\n   \nb:2\n", []string{"a:1", "b:2"})
+	scanTest(t, "a:1\n\t \r\nb:2\n \n\t\nc:3", []string{"a:1", "b:2", "c:3"})
+	scanTest(t, "  a:1  \n\tb:2\n", []string{"a:1\nb:2"})
+}
+
+func TestScanPassportHuge(t *testing.T) {
+	// Much bigger than bufio.MaxScanTokenSize
+	var input bytes.Buffer
+	for i := 0; i < 100000; i++ {
+		input.WriteString("k:v\r\n")
+	}
+	input.WriteString("\r\n")
+
+	value := strings.Repeat("x", 1<<20)
+	input.WriteString("big:" + value + "\n")
+
+	var records [][]byte
+	scanner := NewPassportScanner(&input)
+	for scanner.Scan() {
+		records = append(records, append([]byte{}, scanner.Bytes()...))
+	}
+
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records got %d", len(records))
+	}
+
+	if lines := bytes.Count(records[0], []byte("\n")) + 1; lines != 100000 {
+		t.Errorf("expected 100000 lines got %d", lines)
+	}
+
+	var ppt Passport
+	if err := ppt.UnmarshalText(records[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	if ppt.Fields["big"] != value {
+		t.Errorf("huge value corrupted, length %d", len(ppt.Fields["big"]))
+	}
+}
+
+func TestLoadSchemaArg(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// No schema files here, so the built-in ones are used
+	for _, name := range []string{"strict", "relaxed"} {
+		s, err := loadSchemaArg(name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(s.Fields) != 8 {
+			t.Errorf("%s: expected 8 fields got %d", name, len(s.Fields))
+		}
+	}
+
+	if _, err := loadSchemaArg("missing"); err == nil {
+		t.Error("expected error")
+	}
+
+	// A file on disk takes precedence
+	if err := os.WriteFile("strict.json", []byte(`{"fields": {"x": {"required": true}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := loadSchemaArg("strict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Fields) != 1 || s.Fields["x"] == nil {
+		t.Errorf("expected the schema from disk, got %v", s.Fields)
+	}
+}
+
+// legacyStrictValid is the compiled-in strict policy which strict.json
+// replaced
+func legacyStrictValid(p *Passport) bool {
+	yearRE := regexp.MustCompile("[0-9]{4}")
+	year := func(val string, min, max int) bool {
+		i, err := strconv.Atoi(val)
+		return yearRE.MatchString(val) && err == nil && i >= min && i <= max
+	}
+
+	height := func(val string) bool {
+		var num int
+		var unit string
+		if n, _ := fmt.Sscanf(val, "%d%s", &num, &unit); n != 2 {
+			return false
+		}
+
+		switch unit {
+		case "cm":
+			return num >= 150 && num <= 193
+		case "in":
+			return num >= 59 && num <= 76
+		}
+		return false
+	}
+
+	rules := map[string]func(string) bool{
+		"byr": func(val string) bool { return year(val, 1920, 2002) },
+		"iyr": func(val string) bool { return year(val, 2010, 2020) },
+		"eyr": func(val string) bool { return year(val, 2020, 2030) },
+		"hgt": height,
+		"hcl": regexp.MustCompile("^#[0-9a-f]{6}$").MatchString,
+		"ecl": regexp.MustCompile("^(amb|blu|brn|gry|grn|hzl|oth)$").MatchString,
+		"pid": regexp.MustCompile("^[0-9]{9}$").MatchString,
+	}
+
+	for name, valid := range rules {
+		val, ok := p.Fields[name]
+		if !ok || !valid(val) {
+			return false
+		}
+	}
+
+	return true
+}
+
+const strictExamples = `eyr:1972 cid:100
+hcl:#18171d ecl:amb hgt:170 pid:186cm iyr:2018 byr:1926
+
+iyr:2019
+hcl:#602927 eyr:1967 hgt:170cm
+ecl:grn pid:012533040 byr:1946
+
+hcl:dab227 iyr:2012
+ecl:brn hgt:182cm pid:021572410 eyr:2020 byr:1992 cid:277
+
+hgt:59cm ecl:zzz
+eyr:2038 hcl:74454a iyr:2023
+pid:3556412378 byr:2007
+
+pid:087499704 hgt:74in ecl:grn iyr:2012 eyr:2030 byr:1980
+hcl:#623a2f
+
+eyr:2029 ecl:blu cid:129 byr:1989
+iyr:2014 pid:896056539 hcl:#a97842 hgt:165cm
+
+hcl:#888785
+hgt:164cm byr:2001 iyr:2015 cid:88
+pid:545766238 ecl:hzl
+eyr:2022
+
+iyr:2010 hgt:158cm hcl:#b6652a ecl:blu byr:1944 eyr:2021 pid:093154719
+`
+
+func readPassports(t *testing.T, r io.Reader) []*Passport {
+	var passports []*Passport
+
+	scanner := NewPassportScanner(r)
+	for scanner.Scan() {
+		var ppt Passport
+		if err := ppt.UnmarshalText(scanner.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		passports = append(passports, &ppt)
+	}
+
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return passports
+}
+
+func TestStrictSchemaMatchesLegacy(t *testing.T) {
+	schema, err := LoadSchemaFile("strict.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	passports := readPassports(t, strings.NewReader(strictExamples))
+
+	f, err := os.Open("input.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	passports = append(passports, readPassports(t, f)...)
+
+	valid := 0
+	for _, ppt := range passports {
+		ok, failures := ppt.Valid(schema)
+		if ok != legacyStrictValid(ppt) {
+			t.Errorf("%v: schema says %v (%v), legacy rules disagree", ppt, ok, failures)
+		}
+		if ok {
+			valid++
+		}
+	}
+
+	// 4 of the examples, and the puzzle answer
+	if valid != 4+116 {
+		t.Errorf("expected %d valid got %d", 4+116, valid)
+	}
+}
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func TestFieldSchemaTypes(t *testing.T) {
+	tests := []struct {
+		fs    FieldSchema
+		val   string
+		rules []string
+	}{
+		{FieldSchema{}, "anything at all", nil},
+
+		{FieldSchema{Type: TypeYear, Range: Range{intPtr(1920), intPtr(2002)}}, "1920", nil},
+		{FieldSchema{Type: TypeYear, Range: Range{intPtr(1920), intPtr(2002)}}, "2003", []string{"range"}},
+		{FieldSchema{Type: TypeYear}, "202", []string{"year"}},
+		{FieldSchema{Type: TypeYear}, "02002", []string{"year"}},
+
+		{FieldSchema{Type: TypeNumber, Range: Range{Min: intPtr(-5)}}, "-5", nil},
+		{FieldSchema{Type: TypeNumber, Range: Range{Min: intPtr(-5)}}, "-6", []string{"range"}},
+		{FieldSchema{Type: TypeNumber, Range: Range{Max: intPtr(10)}}, "99999", []string{"range"}},
+		{FieldSchema{Type: TypeNumber}, "12a", []string{"number"}},
+
+		{FieldSchema{Type: TypeNumberUnit, Units: map[string]Range{"cm": {intPtr(150), intPtr(193)}, "in": {}}}, "150cm", nil},
+		{FieldSchema{Type: TypeNumberUnit, Units: map[string]Range{"cm": {intPtr(150), intPtr(193)}, "in": {}}}, "1000in", nil},
+		{FieldSchema{Type: TypeNumberUnit, Units: map[string]Range{"cm": {intPtr(150), intPtr(193)}}}, "194cm", []string{"range"}},
+		{FieldSchema{Type: TypeNumberUnit, Units: map[string]Range{"cm": {intPtr(150), intPtr(193)}}}, "170", []string{"unit"}},
+		{FieldSchema{Type: TypeNumberUnit, Units: map[string]Range{"cm": {}}}, "cm", []string{"number+unit"}},
+
+		{FieldSchema{Type: TypeRegex, Pattern: "^#[0-9a-f]{6}$"}, "#123abc", nil},
+		{FieldSchema{Type: TypeRegex, Pattern: "^#[0-9a-f]{6}$"}, "#123abz", []string{"regex"}},
+
+		{FieldSchema{Type: TypeEnum, Values: []string{"amb", "blu"}}, "blu", nil},
+		{FieldSchema{Type: TypeEnum, Values: []string{"amb", "blu"}}, "bl", []string{"enum"}},
+	}
+
+	for _, test := range tests {
+		fs := test.fs
+		if err := fs.compile(); err != nil {
+			t.Fatalf("%+v: %v", fs, err)
+		}
+
+		failures := fs.check(test.val)
+		if len(failures) != len(test.rules) {
+			t.Errorf("%s %q: expected %v got %v", fs.Type, test.val, test.rules, failures)
+			continue
+		}
+		for i := range failures {
+			if failures[i].Rule != test.rules[i] {
+				t.Errorf("%s %q: expected %v got %v", fs.Type, test.val, test.rules, failures)
+			}
+		}
+	}
+}
+
+func TestValidFailures(t *testing.T) {
+	schema, err := LoadSchema(strings.NewReader(`{
+		"fields": {
+			"byr": { "required": true, "type": "year", "min": 1920, "max": 2002 },
+			"ecl": { "required": true, "type": "enum", "values": ["amb"] },
+			"pid": { "required": true },
+			"cid": { "required": false, "type": "number" }
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ppt Passport
+	if err := ppt.UnmarshalText([]byte("ecl:xyz byr:1900 cid:abc other:1")); err != nil {
+		t.Fatal(err)
+	}
+
+	ok, failures := ppt.Valid(schema)
+	expected := []FieldFailure{
+		{"byr", "range", "1900 not in [1920, 2002]"},
+		{"cid", "number", `"abc" is not a number`},
+		{"ecl", "enum", `"xyz" not one of [amb]`},
+		{"pid", "required", "missing"},
+	}
+
+	if ok || len(failures) != len(expected) {
+		t.Fatalf("expected %v got %v %v", expected, ok, failures)
+	}
+	for i := range expected {
+		if failures[i] != expected[i] {
+			t.Errorf("expected %v got %v", expected[i], failures[i])
+		}
+	}
+
+	// Optional fields may be missing
+	if err := ppt.UnmarshalText([]byte("ecl:amb byr:1920 pid:x")); err != nil {
+		t.Fatal(err)
+	}
+	delete(ppt.Fields, "cid")
+	delete(ppt.Fields, "other")
+	if ok, failures := ppt.Valid(schema); !ok {
+		t.Errorf("expected valid, got %v", failures)
+	}
+}
+
+func TestLoadSchemaErrors(t *testing.T) {
+	tests := []string{
+		`{"fields": {"x": {"type": "colour"}}}`,
+		`{"fields": {"x": {"type": "enum"}}}`,
+		`{"fields": {"x": {"type": "enum", "values": []}}}`,
+		`{"fields": {"x": {"type": "number+unit"}}}`,
+		`{"fields": {"x": {"type": "number+unit", "units": {}}}}`,
+		`{"fields": {"x": {"type": "regex", "pattern": "("}}}`,
+		`{"fields": {"x": {"required": true, "requried": true}}}`,
+		`{"fields": `,
+		`{"fields": {"x": null}}`,
+	}
+
+	for _, src := range tests {
+		if _, err := LoadSchema(strings.NewReader(src)); err == nil {
+			t.Errorf("%s: expected error", src)
+		}
+	}
+}
+
+func samePassport(a, b *Passport) bool {
+	if len(a.Fields) != len(b.Fields) {
+		return false
+	}
+	for k, v := range a.Fields {
+		if bv, ok := b.Fields[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPassportRoundTrip(t *testing.T) {
+	src := "pid:012533040 cid:277\nzzz:a:b:: hgt:170cm unknown:"
+
+	var ppt Passport
+	if err := ppt.UnmarshalText([]byte(src)); err != nil {
+		t.Fatal(err)
+	}
+
+	if ppt.Fields["zzz"] != "a:b::" || ppt.Fields["cid"] != "277" || ppt.Fields["unknown"] != "" {
+		t.Fatalf("unexpected fields: %v", ppt.Fields)
+	}
+
+	text, err := ppt.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "cid:277 hgt:170cm pid:012533040 unknown: zzz:a:b::"
+	if string(text) != expected {
+		t.Errorf("expected %q got %q", expected, text)
+	}
+
+	var fromText Passport
+	if err := fromText.UnmarshalText(text); err != nil {
+		t.Fatal(err)
+	}
+	if !samePassport(&ppt, &fromText) {
+		t.Errorf("text round trip: expected %v got %v", ppt.Fields, fromText.Fields)
+	}
+
+	data, err := json.Marshal(ppt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fromJSON Passport
+	if err := json.Unmarshal(data, &fromJSON); err != nil {
+		t.Fatal(err)
+	}
+	if !samePassport(&ppt, &fromJSON) {
+		t.Errorf("JSON round trip: expected %v got %v", ppt.Fields, fromJSON.Fields)
+	}
+
+	// Values with spaces, or keys with colons, can't be written as text
+	for _, fields := range []map[string]string{
+		{"a": "b c"},
+		{"a": "b\vc"},
+		{"a": "b\u00a0c"},
+		{"a\u00a0b": "c"},
+		{"a:b": "c"},
+		{"": "c"},
+	} {
+		if _, err := (Passport{fields}).MarshalText(); err == nil {
+			t.Errorf("%v: expected error", fields)
+		}
+	}
+}
+
+func writeBatch(t *testing.T, batch string) string {
+	filename := filepath.Join(t.TempDir(), "batch.txt")
+	if err := os.WriteFile(filename, []byte(batch), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return filename
+}
+
+const exportSchema = `{
+	"fields": {
+		"byr": { "required": true, "type": "year", "min": 1920, "max": 2002 },
+		"ecl": { "required": true, "type": "enum", "values": ["amb", "blu"] }
+	}
+}`
+
+const exportBatch = "byr:1980 ecl:amb\n\necl:zzz cid:1:2\n"
+
+func TestExportCSV(t *testing.T) {
+	schema, err := LoadSchema(strings.NewReader(exportSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sb strings.Builder
+	if err := exportCSV(&sb, schema, writeBatch(t, exportBatch)); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `byr,cid,ecl,valid,failures
+1980,,amb,true,
+,1:2,zzz,false,"byr: required: missing; ecl: enum: ""zzz"" not one of [amb blu]"
+`
+	if sb.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, sb.String())
+	}
+}
+
+func TestExportJSONLines(t *testing.T) {
+	schema, err := LoadSchema(strings.NewReader(exportSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sb strings.Builder
+	if err := exportJSONLines(&sb, schema, writeBatch(t, exportBatch)); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"passport":{"byr":"1980","ecl":"amb"},"valid":true,"failures":[]}
+{"passport":{"cid":"1:2","ecl":"zzz"},"valid":false,"failures":["byr: required: missing","ecl: enum: \"zzz\" not one of [amb blu]"]}
+`
+	if sb.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, sb.String())
+	}
+
+	// Each line reads back as the passport it came from
+	dec := json.NewDecoder(strings.NewReader(sb.String()))
+	var record exportRecord
+	if err := dec.Decode(&record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Passport.Fields["byr"] != "1980" || !record.Valid {
+		t.Errorf("unexpected record: %+v", record)
+	}
+}
@@ -2,21 +2,48 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"os"
-	"sort"
+	"strings"
+	"unicode/utf8"
 )
 
-func isUpper(r rune) bool {
-	return r == 'B' || r == 'R'
+// Alphabet is the pair of letters used to pick the lower or upper half of
+// the remaining range at each step of a binary partition
+type Alphabet struct {
+	Lower, Upper rune
 }
 
-func BinarySegment(segments string, setSize int) (int, error) {
+func ParseAlphabet(s string) (Alphabet, error) {
+	if utf8.RuneCountInString(s) != 2 {
+		return Alphabet{}, fmt.Errorf("alphabet must be exactly two letters: %q", s)
+	}
+
+	r := []rune(s)
+	if r[0] == r[1] {
+		return Alphabet{}, fmt.Errorf("alphabet letters must be different: %q", s)
+	}
+
+	return Alphabet{r[0], r[1]}, nil
+}
+
+func (a Alphabet) String() string {
+	return string([]rune{a.Lower, a.Upper})
+}
+
+func BinarySegment(segments string, setSize int, alphabet Alphabet) (int, error) {
 	start := 0
 	for _, s := range segments {
 		setSize /= 2
-		if isUpper(s) {
+		switch s {
+		case alphabet.Upper:
 			start += setSize
+		case alphabet.Lower:
+		default:
+			return 0, fmt.Errorf("invalid letter '%c', expected one of %q", s, alphabet.String())
 		}
 	}
 
@@ -29,52 +56,341 @@ func BinarySegment(segments string, setSize int) (int, error) {
 	return start, nil
 }
 
-func run() error {
-	if len(os.Args) != 2 {
-		return fmt.Errorf("Usage: %s INPUT", os.Args[0])
+type Seat struct {
+	Row int `json:"row"`
+	Col int `json:"col"`
+	ID  int `json:"id"`
+}
+
+// SeatCodec converts between boarding passes and seats for a plane with
+// 2^RowBits rows and 2^ColBits columns. A pass is RowBits letters from
+// RowAlphabet followed by ColBits letters from ColAlphabet.
+type SeatCodec struct {
+	RowBits, ColBits         int
+	RowAlphabet, ColAlphabet Alphabet
+}
+
+func NewSeatCodec(rowBits, colBits int, rowAlphabet, colAlphabet string) (*SeatCodec, error) {
+	if rowBits < 1 || colBits < 1 {
+		return nil, fmt.Errorf("row and column bits must be positive")
+	} else if rowBits+colBits > 62 {
+		return nil, fmt.Errorf("too many bits for a seat ID: %d", rowBits+colBits)
 	}
 
-	f, err := os.Open(os.Args[1])
+	ra, err := ParseAlphabet(rowAlphabet)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	ca, err := ParseAlphabet(colAlphabet)
+	if err != nil {
+		return nil, err
 	}
-	defer f.Close()
 
-	seats := make([]int, 0, 1000)
+	return &SeatCodec{
+		RowBits:     rowBits,
+		ColBits:     colBits,
+		RowAlphabet: ra,
+		ColAlphabet: ca,
+	}, nil
+}
 
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := scanner.Text()
+func (c *SeatCodec) Rows() int {
+	return 1 << c.RowBits
+}
 
-		row, err := BinarySegment(line[:7], 128)
-		if err != nil {
-			return err
+func (c *SeatCodec) Cols() int {
+	return 1 << c.ColBits
+}
+
+func (c *SeatCodec) ID(row, col int) int {
+	return row*c.Cols() + col
+}
+
+func (c *SeatCodec) Decode(pass string) (Seat, error) {
+	runes := []rune(pass)
+	if len(runes) != c.RowBits+c.ColBits {
+		return Seat{}, fmt.Errorf("pass %q has length %d, expected %d", pass, len(runes), c.RowBits+c.ColBits)
+	}
+
+	row, err := BinarySegment(string(runes[:c.RowBits]), c.Rows(), c.RowAlphabet)
+	if err != nil {
+		return Seat{}, fmt.Errorf("pass %q row: %v", pass, err)
+	}
+
+	col, err := BinarySegment(string(runes[c.RowBits:]), c.Cols(), c.ColAlphabet)
+	if err != nil {
+		return Seat{}, fmt.Errorf("pass %q column: %v", pass, err)
+	}
+
+	return Seat{row, col, c.ID(row, col)}, nil
+}
+
+func encodeBits(val, bits int, alphabet Alphabet) []rune {
+	r := make([]rune, bits)
+	for i := bits - 1; i >= 0; i-- {
+		if val&1 == 1 {
+			r[i] = alphabet.Upper
+		} else {
+			r[i] = alphabet.Lower
 		}
+		val >>= 1
+	}
+
+	return r
+}
+
+// Encode produces the boarding pass for the seat at row, col
+func (c *SeatCodec) Encode(row, col int) (string, error) {
+	if row < 0 || row >= c.Rows() {
+		return "", fmt.Errorf("row %d out of range [0, %d)", row, c.Rows())
+	} else if col < 0 || col >= c.Cols() {
+		return "", fmt.Errorf("column %d out of range [0, %d)", col, c.Cols())
+	}
+
+	pass := encodeBits(row, c.RowBits, c.RowAlphabet)
+	pass = append(pass, encodeBits(col, c.ColBits, c.ColAlphabet)...)
+
+	return string(pass), nil
+}
+
+// EncodeID produces the boarding pass for the seat with the given ID
+func (c *SeatCodec) EncodeID(id int) (string, error) {
+	if id < 0 || id >= c.Rows()*c.Cols() {
+		return "", fmt.Errorf("seat ID %d out of range [0, %d)", id, c.Rows()*c.Cols())
+	}
+
+	return c.Encode(id/c.Cols(), id%c.Cols())
+}
 
-		col, err := BinarySegment(line[7:10], 8)
+type DuplicatePass struct {
+	Pass  string `json:"pass"`
+	Seat  Seat   `json:"seat"`
+	Count int    `json:"count"`
+}
+
+// SeatReport summarises the occupancy of a plane from a list of passes
+type SeatReport struct {
+	Rows      int `json:"rows"`
+	Cols      int `json:"cols"`
+	Occupied  int `json:"occupied"`
+	HighestID int `json:"highest_id"`
+
+	// Map has one string per row, with '#' for occupied seats, 'O' for
+	// missing seats with both neighbours occupied, and '.' for other
+	// empty seats. It's left empty for planes with more than MaxMapRows.
+	Map []string `json:"map"`
+
+	// Gaps are the empty seats whose IDs are between two occupied seats
+	Gaps []Seat `json:"gaps"`
+
+	// FrontRows and BackRows are the completely empty rows before the
+	// first and after the last occupied row
+	FrontRows []int `json:"front_rows"`
+	BackRows  []int `json:"back_rows"`
+
+	Duplicates []DuplicatePass `json:"duplicates"`
+}
+
+// MaxReportBits limits the size of plane Report will analyse, as it keeps
+// a flag for every one of the 2^(RowBits+ColBits) seats
+const MaxReportBits = 24
+
+// MaxMapRows is the most rows which Report will draw a map for
+const MaxMapRows = 1024
+
+func (c *SeatCodec) Report(passes []string) (*SeatReport, error) {
+	if c.RowBits+c.ColBits > MaxReportBits {
+		return nil, fmt.Errorf("plane too big to report on: %d row bits, %d column bits (max %d in total)", c.RowBits, c.ColBits, MaxReportBits)
+	}
+
+	r := &SeatReport{
+		Rows:       c.Rows(),
+		Cols:       c.Cols(),
+		HighestID:  -1,
+		Gaps:       []Seat{},
+		FrontRows:  []int{},
+		BackRows:   []int{},
+		Duplicates: []DuplicatePass{},
+	}
+
+	occupied := make([]bool, c.Rows()*c.Cols())
+	counts := make(map[string]int)
+	order := make([]string, 0)
+
+	for _, pass := range passes {
+		seat, err := c.Decode(pass)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		seatId := row*8 + col
-		seats = append(seats, seatId)
+		counts[pass]++
+		if counts[pass] > 1 {
+			if counts[pass] == 2 {
+				order = append(order, pass)
+			}
+			continue
+		}
+
+		occupied[seat.ID] = true
+		r.Occupied++
+		if seat.ID > r.HighestID {
+			r.HighestID = seat.ID
+		}
+	}
+
+	for _, pass := range order {
+		seat, _ := c.Decode(pass)
+		r.Duplicates = append(r.Duplicates, DuplicatePass{pass, seat, counts[pass]})
+	}
+
+	gaps := make(map[int]bool)
+	for id := 1; id < len(occupied)-1; id++ {
+		if !occupied[id] && occupied[id-1] && occupied[id+1] {
+			r.Gaps = append(r.Gaps, Seat{id / c.Cols(), id % c.Cols(), id})
+			gaps[id] = true
+		}
+	}
+
+	rowEmpty := func(row int) bool {
+		for col := 0; col < c.Cols(); col++ {
+			if occupied[c.ID(row, col)] {
+				return false
+			}
+		}
+		return true
+	}
+
+	front := 0
+	for ; front < c.Rows() && rowEmpty(front); front++ {
+		r.FrontRows = append(r.FrontRows, front)
+	}
+
+	back := c.Rows() - 1
+	for ; back >= front && rowEmpty(back); back-- {
+		r.BackRows = append([]int{back}, r.BackRows...)
+	}
+
+	if c.Rows() > MaxMapRows {
+		return r, nil
+	}
+
+	r.Map = make([]string, c.Rows())
+	for row := range r.Map {
+		line := make([]byte, c.Cols())
+		for col := range line {
+			id := c.ID(row, col)
+			switch {
+			case occupied[id]:
+				line[col] = '#'
+			case gaps[id]:
+				line[col] = 'O'
+			default:
+				line[col] = '.'
+			}
+		}
+		r.Map[row] = string(line)
+	}
+
+	return r, nil
+}
+
+func (r *SeatReport) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "Plane: %d rows, %d columns\n", r.Rows, r.Cols)
+	fmt.Fprintln(bw, "Occupied seats:", r.Occupied)
+	fmt.Fprintln(bw, "Highest seat ID:", r.HighestID)
+
+	fmt.Fprintln(bw, "Gaps:")
+	for _, s := range r.Gaps {
+		fmt.Fprintf(bw, "   ID %d (row %d, column %d)\n", s.ID, s.Row, s.Col)
+	}
+
+	fmt.Fprintln(bw, "Empty front rows:", r.FrontRows)
+	fmt.Fprintln(bw, "Empty back rows:", r.BackRows)
+
+	fmt.Fprintln(bw, "Duplicate passes:")
+	for _, d := range r.Duplicates {
+		fmt.Fprintf(bw, "   %s x%d (ID %d)\n", d.Pass, d.Count, d.Seat.ID)
+	}
+
+	fmt.Fprintln(bw)
+	if len(r.Map) == 0 {
+		fmt.Fprintf(bw, "(no map for more than %d rows)\n", MaxMapRows)
+	}
+	for row, line := range r.Map {
+		fmt.Fprintf(bw, "%4d %s\n", row, line)
+	}
+
+	return bw.Flush()
+}
+
+// ReadPasses reads one boarding pass per line, skipping blank lines
+func ReadPasses(r io.Reader) ([]string, error) {
+	passes := make([]string, 0, 1000)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+
+		passes = append(passes, line)
 	}
 
 	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return passes, nil
+}
+
+func run() error {
+	rowBits := flag.Int("row-bits", 7, "number of letters encoding the row")
+	colBits := flag.Int("col-bits", 3, "number of letters encoding the column")
+	rowAlphabet := flag.String("row-letters", "FB", "letters for the lower and upper half of the rows")
+	colAlphabet := flag.String("col-letters", "LR", "letters for the lower and upper half of the columns")
+	format := flag.String("format", "text", "report format: text or json")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		return fmt.Errorf("Usage: %s [OPTIONS] INPUT", os.Args[0])
+	}
+
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("unknown format: %s", *format)
+	}
+
+	codec, err := NewSeatCodec(*rowBits, *colBits, *rowAlphabet, *colAlphabet)
+	if err != nil {
 		return err
 	}
 
-	sort.Ints(seats)
-	fmt.Println("Number of seats:", seats[len(seats)-1])
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 
-	for i, s := range seats {
-		if s+1 != seats[i+1] {
-			fmt.Println("My seat:", s+1)
-			break
-		}
+	passes, err := ReadPasses(f)
+	if err != nil {
+		return err
+	}
+
+	report, err := codec.Report(passes)
+	if err != nil {
+		return err
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		return enc.Encode(report)
 	}
 
-	return nil
+	return report.WriteText(os.Stdout)
 }
 
 func main() {
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"strings"
 	"testing"
 )
 
-func segmentTest(t *testing.T, segments string, setSize, expected int) {
-	r, err := BinarySegment(segments, setSize)
+var rowAlphabet = Alphabet{'F', 'B'}
+var colAlphabet = Alphabet{'L', 'R'}
+
+func segmentTest(t *testing.T, segments string, setSize int, alphabet Alphabet, expected int) {
+	r, err := BinarySegment(segments, setSize, alphabet)
 	if err != nil {
 		t.Fatal(err)
 	} else if r != expected {
@@ -14,10 +18,217 @@ func segmentTest(t *testing.T, segments string, setSize, expected int) {
 }
 
 func TestBinarySegment(t *testing.T) {
-	segmentTest(t, "F", 2, 0)
-	segmentTest(t, "B", 2, 1)
-	segmentTest(t, "FB", 4, 1)
-	segmentTest(t, "BFFFBBF", 128, 70)
-	segmentTest(t, "RRR", 8, 7)
-	segmentTest(t, "RLL", 8, 4)
+	segmentTest(t, "F", 2, rowAlphabet, 0)
+	segmentTest(t, "B", 2, rowAlphabet, 1)
+	segmentTest(t, "FB", 4, rowAlphabet, 1)
+	segmentTest(t, "BFFFBBF", 128, rowAlphabet, 70)
+	segmentTest(t, "RRR", 8, colAlphabet, 7)
+	segmentTest(t, "RLL", 8, colAlphabet, 4)
+}
+
+func TestBinarySegmentInvalid(t *testing.T) {
+	if _, err := BinarySegment("FXF", 8, rowAlphabet); err == nil {
+		t.Errorf("expected error for invalid letter")
+	}
+
+	if _, err := BinarySegment("RRR", 8, rowAlphabet); err == nil {
+		t.Errorf("expected error for letters from the wrong alphabet")
+	}
+}
+
+func decodeTest(t *testing.T, c *SeatCodec, pass string, row, col, id int) {
+	seat, err := c.Decode(pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Seat{row, col, id}
+	if seat != expected {
+		t.Errorf("%s: expected %v got %v", pass, expected, seat)
+	}
+
+	enc, err := c.Encode(row, col)
+	if err != nil {
+		t.Fatal(err)
+	} else if enc != pass {
+		t.Errorf("%d,%d: expected %s got %s", row, col, pass, enc)
+	}
+
+	enc, err = c.EncodeID(id)
+	if err != nil {
+		t.Fatal(err)
+	} else if enc != pass {
+		t.Errorf("%d: expected %s got %s", id, pass, enc)
+	}
+}
+
+func TestSeatCodec(t *testing.T) {
+	c, err := NewSeatCodec(7, 3, "FB", "LR")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decodeTest(t, c, "FBFBBFFRLR", 44, 5, 357)
+	decodeTest(t, c, "BFFFBBFRRR", 70, 7, 567)
+	decodeTest(t, c, "FFFBBBFRRR", 14, 7, 119)
+	decodeTest(t, c, "BBFFBBFRLL", 102, 4, 820)
+
+	small, err := NewSeatCodec(2, 1, "01", "ab")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decodeTest(t, small, "00a", 0, 0, 0)
+	decodeTest(t, small, "10b", 2, 1, 5)
+	decodeTest(t, small, "11b", 3, 1, 7)
+
+	unicode, err := NewSeatCodec(3, 2, "↑↓", "←→")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decodeTest(t, unicode, "↓↑↓→←", 5, 2, 22)
+}
+
+func TestSeatCodecErrors(t *testing.T) {
+	c, err := NewSeatCodec(7, 3, "FB", "LR")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pass := range []string{"", "FBFBBFFRL", "FBFBBFFRLRR", "FBFBBFFRLX", "FBFBBFRRLR", "FBFBBFFFLR"} {
+		if _, err := c.Decode(pass); err == nil {
+			t.Errorf("%q: expected error", pass)
+		}
+	}
+
+	if _, err := c.Encode(128, 0); err == nil {
+		t.Errorf("expected error for row out of range")
+	}
+
+	if _, err := c.Encode(0, -1); err == nil {
+		t.Errorf("expected error for column out of range")
+	}
+
+	if _, err := c.EncodeID(1024); err == nil {
+		t.Errorf("expected error for ID out of range")
+	}
+
+	if _, err := NewSeatCodec(7, 3, "FF", "LR"); err == nil {
+		t.Errorf("expected error for repeated alphabet letter")
+	}
+
+	if _, err := NewSeatCodec(7, 3, "FB", "LRX"); err == nil {
+		t.Errorf("expected error for alphabet length")
+	}
+}
+
+func TestReadPasses(t *testing.T) {
+	passes, err := ReadPasses(strings.NewReader("FBFBBFFRLR\n\n  BFFFBBFRRR \r\nFFFBBBFRRR\n\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"FBFBBFFRLR", "BFFFBBFRRR", "FFFBBBFRRR"}
+	if strings.Join(passes, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v got %v", expected, passes)
+	}
+}
+
+func TestSeatReport(t *testing.T) {
+	c, err := NewSeatCodec(2, 1, "FB", "LR")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Row 0 empty, ID 3 missing, IDs 2 and 4 duplicated, row 3 empty
+	passes := []string{"FBL", "BFL", "BFR", "FBL", "BFL"}
+
+	r, err := c.Report(passes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Occupied != 3 {
+		t.Errorf("expected 3 occupied got %d", r.Occupied)
+	}
+
+	if r.HighestID != 5 {
+		t.Errorf("expected highest ID 5 got %d", r.HighestID)
+	}
+
+	if len(r.Gaps) != 1 || r.Gaps[0] != (Seat{1, 1, 3}) {
+		t.Errorf("expected gap at ID 3 got %v", r.Gaps)
+	}
+
+	if len(r.FrontRows) != 1 || r.FrontRows[0] != 0 {
+		t.Errorf("expected front rows [0] got %v", r.FrontRows)
+	}
+
+	if len(r.BackRows) != 1 || r.BackRows[0] != 3 {
+		t.Errorf("expected back rows [3] got %v", r.BackRows)
+	}
+
+	if len(r.Duplicates) != 2 || r.Duplicates[0].Pass != "FBL" || r.Duplicates[0].Count != 2 {
+		t.Errorf("unexpected duplicates %v", r.Duplicates)
+	}
+
+	expectedMap := []string{"..", "#O", "##", ".."}
+	for i, line := range expectedMap {
+		if r.Map[i] != line {
+			t.Errorf("map row %d: expected %q got %q", i, line, r.Map[i])
+		}
+	}
+}
+
+func TestSeatReportNoGap(t *testing.T) {
+	c, err := NewSeatCodec(1, 1, "FB", "LR")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := c.Report([]string{"FL", "FR", "BL", "BR"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.Gaps) != 0 || len(r.FrontRows) != 0 || len(r.BackRows) != 0 {
+		t.Errorf("expected no gaps or empty rows, got %v", r)
+	}
+}
+
+func TestSeatReportLargePlane(t *testing.T) {
+	c, err := NewSeatCodec(40, 3, "FB", "LR")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Report([]string{strings.Repeat("F", 40) + "LLL"}); err == nil {
+		t.Error("expected error for a huge plane")
+	}
+
+	// Big enough to skip the map, but small enough to analyse
+	c, err = NewSeatCodec(12, 3, "FB", "LR")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pass := strings.Repeat("F", 11) + "BLLR"
+	r, err := c.Report([]string{pass})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Map != nil || r.Occupied != 1 || r.HighestID != 9 || len(r.FrontRows) != 1 || len(r.BackRows) != 4094 {
+		t.Errorf("unexpected report: map %d rows, %d occupied, highest %d, %d front rows, %d back rows",
+			len(r.Map), r.Occupied, r.HighestID, len(r.FrontRows), len(r.BackRows))
+	}
+
+	var sb strings.Builder
+	if err := r.WriteText(&sb); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(sb.String(), "no map") {
+		t.Errorf("expected a note about the missing map:\n%s", sb.String())
+	}
 }
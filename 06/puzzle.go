@@ -2,91 +2,556 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"math/bits"
 	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"unicode"
 )
 
-type Form [26]bool
+// Alphabet is the set of possible answers (questions) on a form. Each letter
+// is given an index into the Form bitset.
+type Alphabet struct {
+	letters []rune
+	index   map[rune]int
+}
+
+func NewAlphabet(letters string) (*Alphabet, error) {
+	a := &Alphabet{
+		index: make(map[rune]int),
+	}
+
+	for _, r := range letters {
+		if _, ok := a.index[r]; ok {
+			return nil, fmt.Errorf("duplicate letter '%c' in alphabet", r)
+		}
+
+		a.index[r] = len(a.letters)
+		a.letters = append(a.letters, r)
+	}
+
+	if len(a.letters) == 0 {
+		return nil, fmt.Errorf("empty alphabet")
+	}
+
+	return a, nil
+}
+
+// DetectAlphabet builds an alphabet from every non-whitespace letter which
+// appears in lines, in sorted order
+func DetectAlphabet(lines []string) (*Alphabet, error) {
+	seen := make(map[rune]bool)
+	for _, l := range lines {
+		for _, r := range l {
+			if !unicode.IsSpace(r) {
+				seen[r] = true
+			}
+		}
+	}
+
+	letters := make([]rune, 0, len(seen))
+	for r := range seen {
+		letters = append(letters, r)
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i] < letters[j] })
+
+	return NewAlphabet(string(letters))
+}
+
+func (a *Alphabet) Len() int {
+	return len(a.letters)
+}
+
+func (a *Alphabet) Letter(i int) rune {
+	return a.letters[i]
+}
+
+func (a *Alphabet) String() string {
+	return string(a.letters)
+}
 
-func (f *Form) Answer(r rune) {
-	idx := r - 'a'
-	f[idx] = true
+var DefaultAlphabet *Alphabet
+
+func init() {
+	DefaultAlphabet, _ = NewAlphabet("abcdefghijklmnopqrstuvwxyz")
+}
+
+// Form is the set of questions answered "yes", stored as a bitset indexed
+// by the position of each letter in its Alphabet. The zero value is an empty
+// form using DefaultAlphabet.
+type Form struct {
+	alphabet *Alphabet
+	bits     []uint64
+}
+
+func NewForm(alphabet *Alphabet) *Form {
+	return &Form{
+		alphabet: alphabet,
+		bits:     make([]uint64, (alphabet.Len()+63)/64),
+	}
+}
+
+func (f *Form) init() {
+	if f.alphabet == nil {
+		f.alphabet = DefaultAlphabet
+	}
+
+	if f.bits == nil {
+		f.bits = make([]uint64, (f.alphabet.Len()+63)/64)
+	}
+}
+
+func (f *Form) Alphabet() *Alphabet {
+	f.init()
+	return f.alphabet
+}
+
+func (f *Form) Answer(r rune) error {
+	f.init()
+
+	idx, ok := f.alphabet.index[r]
+	if !ok {
+		return fmt.Errorf("answer '%c' not in alphabet %q", r, f.alphabet.String())
+	}
+
+	f.bits[idx/64] |= 1 << (idx % 64)
+
+	return nil
+}
+
+func (f *Form) Has(idx int) bool {
+	f.init()
+	return f.bits[idx/64]&(1<<(idx%64)) != 0
+}
+
+func (f *Form) set(idx int) {
+	f.bits[idx/64] |= 1 << (idx % 64)
 }
 
 func (f *Form) Sum() int {
+	f.init()
+
 	sum := 0
-	for _, v := range f {
-		if v {
-			sum++
-		}
+	for _, v := range f.bits {
+		sum += bits.OnesCount64(v)
 	}
 
 	return sum
 }
 
-type CombineFunc func(a, b bool) bool
+func (f *Form) String() string {
+	f.init()
+
+	var sb strings.Builder
+	for i, r := range f.alphabet.letters {
+		if f.Has(i) {
+			sb.WriteRune(r)
+		}
+	}
+
+	return sb.String()
+}
+
+// CombineFunc combines 64 answers from each of two forms at once
+type CombineFunc func(a, b uint64) uint64
 
-func And(a, b bool) bool {
-	return a && b
+func And(a, b uint64) uint64 {
+	return a & b
 }
 
-func Or(a, b bool) bool {
-	return a || b
+func Or(a, b uint64) uint64 {
+	return a | b
 }
 
-func (f *Form) Combine(other Form, op CombineFunc) {
-	for i, v := range other {
-		f[i] = op(f[i], v)
+func Xor(a, b uint64) uint64 {
+	return a ^ b
+}
+
+func (f *Form) Combine(other Form, op CombineFunc) error {
+	f.init()
+	other.init()
+
+	if f.alphabet != other.alphabet {
+		return fmt.Errorf("can't combine forms with different alphabets")
 	}
+
+	for i, v := range other.bits {
+		f.bits[i] = op(f.bits[i], v)
+	}
+
+	// Keep the bits past the end of the alphabet clear, whatever op does
+	if rem := f.alphabet.Len() % 64; rem != 0 {
+		f.bits[len(f.bits)-1] &= (1 << rem) - 1
+	}
+
+	return nil
 }
 
-func run() error {
-	if len(os.Args) < 2 {
-		return fmt.Errorf("Usage: %s INPUT [PART2]", os.Args[0])
+// GroupCombiner produces a single form from a group's individual forms
+type GroupCombiner func(group []*Form) (*Form, error)
+
+// groupAlphabet returns the alphabet shared by every form in the group
+func groupAlphabet(group []*Form) (*Alphabet, error) {
+	if len(group) == 0 {
+		return nil, fmt.Errorf("can't combine an empty group")
 	}
 
-	f, err := os.Open(os.Args[1])
-	if err != nil {
-		return err
+	alphabet := group[0].Alphabet()
+	for _, f := range group[1:] {
+		if f.Alphabet() != alphabet {
+			return nil, fmt.Errorf("can't combine forms with different alphabets")
+		}
 	}
-	defer f.Close()
 
-	combineOp := Or
-	if len(os.Args) > 2 {
-		combineOp = And
+	return alphabet, nil
+}
+
+// Fold combines each form in turn using op
+func Fold(op CombineFunc) GroupCombiner {
+	return func(group []*Form) (*Form, error) {
+		alphabet, err := groupAlphabet(group)
+		if err != nil {
+			return nil, err
+		}
+
+		result := NewForm(alphabet)
+		copy(result.bits, group[0].bits)
+
+		for _, f := range group[1:] {
+			if err := result.Combine(*f, op); err != nil {
+				return nil, err
+			}
+		}
+
+		return result, nil
 	}
+}
 
-	totalAnswers := 0
+// Between selects the questions answered by at least min and at most max
+// people in the group. min and max are computed from the group size, n.
+func Between(bounds func(n int) (min, max int)) GroupCombiner {
+	return func(group []*Form) (*Form, error) {
+		alphabet, err := groupAlphabet(group)
+		if err != nil {
+			return nil, err
+		}
+
+		result := NewForm(alphabet)
+
+		min, max := bounds(len(group))
+		for i := 0; i < alphabet.Len(); i++ {
+			count := 0
+			for _, f := range group {
+				if f.Has(i) {
+					count++
+				}
+			}
 
-	var group *Form
+			if count >= min && count <= max {
+				result.set(i)
+			}
+		}
 
-	scanner := bufio.NewScanner(f)
+		return result, nil
+	}
+}
+
+func AtLeast(k int) GroupCombiner {
+	return Between(func(n int) (int, int) { return k, n })
+}
+
+var Majority GroupCombiner = Between(func(n int) (int, int) { return n/2 + 1, n })
+
+var ExactlyOne GroupCombiner = Between(func(n int) (int, int) { return 1, 1 })
+
+// ReadGroups splits the input into groups of lines separated by blank lines
+func ReadGroups(r io.Reader) ([][]string, error) {
+	var groups [][]string
+	var group []string
+
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
-		line := scanner.Text()
+		line := strings.TrimSpace(scanner.Text())
 
 		if len(line) == 0 {
-			totalAnswers += group.Sum()
+			if len(group) > 0 {
+				groups = append(groups, group)
+			}
 			group = nil
 		} else {
-			var individual Form
-			for _, a := range line {
-				individual.Answer(a)
+			group = append(group, line)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// If there's no blank line at EOF
+	if len(group) > 0 {
+		groups = append(groups, group)
+	}
+
+	return groups, nil
+}
+
+func ParseForm(alphabet *Alphabet, line string) (*Form, error) {
+	f := NewForm(alphabet)
+	for _, a := range line {
+		if unicode.IsSpace(a) {
+			continue
+		}
+
+		if err := f.Answer(a); err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+func ParseGroup(alphabet *Alphabet, lines []string) ([]*Form, error) {
+	group := make([]*Form, 0, len(lines))
+	for _, l := range lines {
+		f, err := ParseForm(alphabet, l)
+		if err != nil {
+			return nil, err
+		}
+
+		group = append(group, f)
+	}
+
+	return group, nil
+}
+
+type QuestionStats struct {
+	Question string `json:"question"`
+	// Groups is the number of groups where anyone answered the question
+	Groups int `json:"groups"`
+	// People is the number of people who answered it
+	People int `json:"people"`
+	// Unanimous is the number of groups where everyone answered it
+	Unanimous int `json:"unanimous"`
+}
+
+type GroupSizeCount struct {
+	Size   int `json:"size"`
+	Groups int `json:"groups"`
+}
+
+type SurveyStats struct {
+	Groups    int              `json:"groups"`
+	People    int              `json:"people"`
+	Questions []QuestionStats  `json:"questions"`
+	GroupSize []GroupSizeCount `json:"group_sizes"`
+
+	// MostUnanimous lists the questions answered unanimously by at least
+	// one group, most often first
+	MostUnanimous []QuestionStats `json:"most_unanimous"`
+
+	// NoCommonAnswer holds the (1-based) numbers of groups whose members
+	// have no answer in common
+	NoCommonAnswer []int `json:"no_common_answer"`
+}
+
+func Stats(alphabet *Alphabet, groups [][]*Form) *SurveyStats {
+	stats := &SurveyStats{
+		Groups:         len(groups),
+		Questions:      make([]QuestionStats, alphabet.Len()),
+		MostUnanimous:  []QuestionStats{},
+		NoCommonAnswer: []int{},
+	}
+
+	for i := range stats.Questions {
+		stats.Questions[i].Question = string(alphabet.Letter(i))
+	}
+
+	sizes := make(map[int]int)
+
+	for gi, group := range groups {
+		stats.People += len(group)
+		sizes[len(group)]++
+
+		common := false
+		for i := range stats.Questions {
+			q := &stats.Questions[i]
+
+			count := 0
+			for _, f := range group {
+				if f.Has(i) {
+					count++
+				}
 			}
 
-			if group == nil {
-				group = &individual
-			} else {
-				group.Combine(individual, combineOp)
+			q.People += count
+			if count > 0 {
+				q.Groups++
+			}
+			if count == len(group) {
+				q.Unanimous++
+				common = true
 			}
 		}
+
+		if !common || len(group) == 0 {
+			stats.NoCommonAnswer = append(stats.NoCommonAnswer, gi+1)
+		}
 	}
 
-	if err := scanner.Err(); err != nil {
+	for size, n := range sizes {
+		stats.GroupSize = append(stats.GroupSize, GroupSizeCount{size, n})
+	}
+	sort.Slice(stats.GroupSize, func(i, j int) bool {
+		return stats.GroupSize[i].Size < stats.GroupSize[j].Size
+	})
+
+	for _, q := range stats.Questions {
+		if q.Unanimous > 0 {
+			stats.MostUnanimous = append(stats.MostUnanimous, q)
+		}
+	}
+	sort.SliceStable(stats.MostUnanimous, func(i, j int) bool {
+		return stats.MostUnanimous[i].Unanimous > stats.MostUnanimous[j].Unanimous
+	})
+
+	return stats
+}
+
+func (s *SurveyStats) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+
+	fmt.Fprintf(tw, "Groups:\t%d\t\n", s.Groups)
+	fmt.Fprintf(tw, "People:\t%d\t\n", s.People)
+	fmt.Fprintln(tw)
+
+	fmt.Fprintln(tw, "Question\tGroups\tPeople\tUnanimous\t")
+	for _, q := range s.Questions {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t\n", q.Question, q.Groups, q.People, q.Unanimous)
+	}
+	fmt.Fprintln(tw)
+
+	fmt.Fprintln(tw, "Group size\tGroups\t")
+	for _, gs := range s.GroupSize {
+		fmt.Fprintf(tw, "%d\t%d\t\n", gs.Size, gs.Groups)
+	}
+	fmt.Fprintln(tw)
+
+	fmt.Fprintln(tw, "Most unanimous\tGroups\t")
+	for _, q := range s.MostUnanimous {
+		fmt.Fprintf(tw, "%s\t%d\t\n", q.Question, q.Unanimous)
+	}
+
+	if err := tw.Flush(); err != nil {
 		return err
 	}
 
-	// If there's no blank line at EOF
-	totalAnswers += group.Sum()
+	_, err := fmt.Fprintln(w, "\nGroups with no common answer:", s.NoCommonAnswer)
+
+	return err
+}
+
+func run() error {
+	alphabetArg := flag.String("alphabet", "a-z", "answer letters, \"a-z\", or \"auto\" to detect from the input")
+	combine := flag.String("combine", "", "group combiner: any, all, xor, majority, exactly-one or at-least")
+	k := flag.Int("k", 2, "number of people for the at-least combiner")
+	report := flag.String("report", "", "print survey statistics instead of the sum, as a \"table\" or \"json\"")
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		return fmt.Errorf("Usage: %s [OPTIONS] INPUT [PART2]", os.Args[0])
+	}
+
+	if *k < 1 {
+		return fmt.Errorf("-k must be at least 1, got %d", *k)
+	}
+
+	if *combine == "" {
+		*combine = "any"
+		if flag.NArg() > 1 {
+			*combine = "all"
+		}
+	}
+
+	combiners := map[string]GroupCombiner{
+		"any":         Fold(Or),
+		"all":         Fold(And),
+		"xor":         Fold(Xor),
+		"majority":    Majority,
+		"exactly-one": ExactlyOne,
+		"at-least":    AtLeast(*k),
+	}
+
+	combiner, ok := combiners[*combine]
+	if !ok {
+		return fmt.Errorf("unknown combiner: %s", *combine)
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	groups, err := ReadGroups(f)
+	if err != nil {
+		return err
+	}
+
+	var alphabet *Alphabet
+	switch *alphabetArg {
+	case "a-z":
+		alphabet = DefaultAlphabet
+	case "auto":
+		var lines []string
+		for _, g := range groups {
+			lines = append(lines, g...)
+		}
+
+		alphabet, err = DetectAlphabet(lines)
+	default:
+		alphabet, err = NewAlphabet(*alphabetArg)
+	}
+	if err != nil {
+		return err
+	}
+
+	forms := make([][]*Form, 0, len(groups))
+	for _, lines := range groups {
+		group, err := ParseGroup(alphabet, lines)
+		if err != nil {
+			return err
+		}
+
+		forms = append(forms, group)
+	}
+
+	switch *report {
+	case "":
+	case "table":
+		return Stats(alphabet, forms).WriteTable(os.Stdout)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		return enc.Encode(Stats(alphabet, forms))
+	default:
+		return fmt.Errorf("unknown report format: %s", *report)
+	}
+
+	totalAnswers := 0
+
+	for _, group := range forms {
+		result, err := combiner(group)
+		if err != nil {
+			return err
+		}
+
+		totalAnswers += result.Sum()
+	}
 
 	fmt.Println(totalAnswers)
 
@@ -60,3 +60,185 @@ func TestCobine(t *testing.T) {
 	doCombineTest(t, []string{"a", "a", "a", "a"}, And, 1)
 	doCombineTest(t, []string{"b"}, And, 1)
 }
+
+func TestFormOutsideAlphabet(t *testing.T) {
+	var f Form
+	if err := f.Answer('A'); err == nil {
+		t.Errorf("expected error for answer outside default alphabet")
+	}
+
+	if err := f.Answer('é'); err == nil {
+		t.Errorf("expected error for answer outside default alphabet")
+	}
+}
+
+func TestCustomAlphabet(t *testing.T) {
+	if _, err := NewAlphabet("abca"); err == nil {
+		t.Errorf("expected error for duplicate letter")
+	}
+
+	// More than 64 letters, so more than one word in the bitset
+	letters := ""
+	for r := rune(0x100); r < 0x100+100; r++ {
+		letters += string(r)
+	}
+
+	alphabet, err := NewAlphabet(letters)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ParseForm(alphabet, string([]rune{0x100, 0x150, 0x163}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Sum() != 3 {
+		t.Errorf("expected 3 got %d", f.Sum())
+	}
+
+	if _, err := ParseForm(alphabet, "a"); err == nil {
+		t.Errorf("expected error for answer outside alphabet")
+	}
+}
+
+func TestDetectAlphabet(t *testing.T) {
+	alphabet, err := DetectAlphabet([]string{"zA", "1 é", "Az"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if alphabet.String() != "1Azé" {
+		t.Errorf("expected \"1Azé\" got %q", alphabet.String())
+	}
+}
+
+func doGroupTest(t *testing.T, answers []string, combiner GroupCombiner, expected string) {
+	alphabet, err := DetectAlphabet([]string{"abcdef"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	group, err := ParseGroup(alphabet, answers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form, err := combiner(group)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := form.String()
+	if result != expected {
+		t.Errorf("%v: expected %q got %q", answers, expected, result)
+	}
+}
+
+func TestGroupCombiners(t *testing.T) {
+	doGroupTest(t, []string{"ab", "ac"}, Fold(Or), "abc")
+	doGroupTest(t, []string{"ab", "ac"}, Fold(And), "a")
+
+	doGroupTest(t, []string{"ab", "ac"}, Fold(Xor), "bc")
+	doGroupTest(t, []string{"a", "a", "a"}, Fold(Xor), "a")
+
+	doGroupTest(t, []string{"abc", "ab", "a", "d"}, AtLeast(2), "ab")
+	doGroupTest(t, []string{"abc", "ab", "a", "d"}, AtLeast(4), "")
+	doGroupTest(t, []string{"abc", "ab", "a", "d"}, AtLeast(1), "abcd")
+
+	doGroupTest(t, []string{"abc", "ab", "a", "d"}, Majority, "a")
+	doGroupTest(t, []string{"abc", "ab", "a"}, Majority, "ab")
+	doGroupTest(t, []string{"f"}, Majority, "f")
+
+	doGroupTest(t, []string{"abc", "ab", "a", "d"}, ExactlyOne, "cd")
+	doGroupTest(t, []string{"a", "a"}, ExactlyOne, "")
+}
+
+func TestGroupCombinerErrors(t *testing.T) {
+	abc, err := NewAlphabet("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xyz, err := NewAlphabet("xyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := ParseForm(abc, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	x, err := ParseForm(xyz, "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	combiners := map[string]GroupCombiner{
+		"any":         Fold(Or),
+		"majority":    Majority,
+		"exactly-one": ExactlyOne,
+	}
+
+	for name, combiner := range combiners {
+		if _, err := combiner(nil); err == nil {
+			t.Errorf("%s: expected error for empty group", name)
+		}
+
+		if _, err := combiner([]*Form{a, x}); err == nil {
+			t.Errorf("%s: expected error for mixed alphabets", name)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	alphabet, err := NewAlphabet("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var groups [][]*Form
+	for _, lines := range [][]string{{"abc"}, {"a", "b", "c"}, {"ab", "ac"}, {"a", "a", "a", "a"}, {"b"}} {
+		group, err := ParseGroup(alphabet, lines)
+		if err != nil {
+			t.Fatal(err)
+		}
+		groups = append(groups, group)
+	}
+
+	stats := Stats(alphabet, groups)
+
+	if stats.Groups != 5 || stats.People != 11 {
+		t.Errorf("expected 5 groups, 11 people got %d, %d", stats.Groups, stats.People)
+	}
+
+	expectedQuestions := []QuestionStats{
+		{"a", 4, 8, 3},
+		{"b", 4, 4, 2},
+		{"c", 3, 3, 1},
+	}
+	for i, q := range expectedQuestions {
+		if stats.Questions[i] != q {
+			t.Errorf("expected %v got %v", q, stats.Questions[i])
+		}
+	}
+
+	expectedSizes := []GroupSizeCount{{1, 2}, {2, 1}, {3, 1}, {4, 1}}
+	if len(stats.GroupSize) != len(expectedSizes) {
+		t.Fatalf("expected %v got %v", expectedSizes, stats.GroupSize)
+	}
+	for i, gs := range expectedSizes {
+		if stats.GroupSize[i] != gs {
+			t.Errorf("expected %v got %v", gs, stats.GroupSize[i])
+		}
+	}
+
+	if len(stats.MostUnanimous) != 3 || stats.MostUnanimous[0].Question != "a" {
+		t.Errorf("unexpected unanimous ranking %v", stats.MostUnanimous)
+	}
+
+	if len(stats.NoCommonAnswer) != 1 || stats.NoCommonAnswer[0] != 2 {
+		t.Errorf("expected no common answer in group 2, got %v", stats.NoCommonAnswer)
+	}
+}
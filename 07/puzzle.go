@@ -2,9 +2,13 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -25,10 +29,93 @@ var numberedOrNoneRE *regexp.Regexp = regexp.MustCompile(numberedOrNoneStr)
 
 type Rules struct {
 	Bags map[string]*Bag
+
+	// containedIn is the reverse of each Bag's Contents: for each color,
+	// the bags which directly contain it and how many. It's built by
+	// ParseRules, or lazily by the queries which need it.
+	containedIn map[string]map[string]int
+
+	// Colors which AddBag has seen more than once
+	duplicates []string
+
+	// Memoized query results, reset whenever the rules change
+	validation *ValidationReport
+	containers map[string][]string
+	counts     map[string]int
+}
+
+func NewRules() *Rules {
+	return &Rules{
+		Bags: make(map[string]*Bag),
+	}
+}
+
+func ParseRules(r io.Reader) (*Rules, error) {
+	rules := NewRules()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		bag, err := NewBag(line)
+		if err != nil {
+			return nil, err
+		}
+
+		rules.AddBag(bag)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	rules.buildIndex()
+
+	return rules, nil
 }
 
 func (r *Rules) AddBag(b *Bag) {
+	if _, ok := r.Bags[b.Color]; ok {
+		r.duplicates = append(r.duplicates, b.Color)
+	}
+
 	r.Bags[b.Color] = b
+	r.Invalidate()
+}
+
+// Invalidate drops the reverse index and memoized results. It must be
+// called if any Bag's Contents are modified after queries have been made.
+func (r *Rules) Invalidate() {
+	r.containedIn = nil
+	r.validation = nil
+	r.containers = nil
+	r.counts = nil
+}
+
+func (r *Rules) buildIndex() {
+	r.containedIn = make(map[string]map[string]int)
+	for _, outer := range r.Bags {
+		for inner, n := range outer.Contents {
+			if r.containedIn[inner] == nil {
+				r.containedIn[inner] = make(map[string]int)
+			}
+			r.containedIn[inner][outer.Color] = n
+		}
+	}
+
+	r.containers = make(map[string][]string)
+	r.counts = make(map[string]int)
+}
+
+func (r *Rules) index() map[string]map[string]int {
+	if r.containedIn == nil {
+		r.buildIndex()
+	}
+
+	return r.containedIn
 }
 
 func (r *Rules) GetColor(color string) (*Bag, bool) {
@@ -36,9 +123,321 @@ func (r *Rules) GetColor(color string) (*Bag, bool) {
 	return bag, ok
 }
 
+// Bag is like GetColor, but returns an error for an unknown color
+func (r *Rules) Bag(color string) (*Bag, error) {
+	bag, ok := r.Bags[color]
+	if !ok {
+		return nil, fmt.Errorf("unknown bag color: %q", color)
+	}
+
+	return bag, nil
+}
+
+type DanglingRef struct {
+	Bag     string
+	Missing string
+}
+
+// ValidationReport lists the problems found in a set of rules.
+//
+// Cycles, dangling references and duplicate definitions make queries
+// meaningless (or never terminate), so they are errors. Unreachable bags -
+// those which aren't inside any other bag and have no contents of their
+// own - take no part in any query, so they're only reported.
+type ValidationReport struct {
+	// Each cycle starts and ends with the same color
+	Cycles      [][]string
+	Dangling    []DanglingRef
+	Duplicates  []string
+	Unreachable []string
+}
+
+// Err returns an error describing the first few problems, or nil if there
+// are none which prevent queries
+func (v *ValidationReport) Err() error {
+	var problems []string
+
+	for _, c := range v.Cycles {
+		problems = append(problems, "cycle: "+strings.Join(c, " -> "))
+	}
+
+	for _, d := range v.Dangling {
+		problems = append(problems, fmt.Sprintf("%q contains undefined %q", d.Bag, d.Missing))
+	}
+
+	for _, d := range v.Duplicates {
+		problems = append(problems, fmt.Sprintf("%q defined more than once", d))
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	const maxProblems = 5
+	if len(problems) > maxProblems {
+		problems = append(problems[:maxProblems], fmt.Sprintf("and %d more", len(problems)-maxProblems))
+	}
+
+	return fmt.Errorf("invalid rules: %s", strings.Join(problems, "; "))
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Validate checks the rules for cycles, references to undefined colors,
+// colors defined more than once and unreachable bags. Every query calls it
+// first, and fails if the report's Err() is non-nil.
+func (r *Rules) Validate() *ValidationReport {
+	if r.validation != nil {
+		return r.validation
+	}
+
+	v := &ValidationReport{
+		Duplicates: append([]string{}, r.duplicates...),
+	}
+	sort.Strings(v.Duplicates)
+
+	colors := make([]string, 0, len(r.Bags))
+	for c := range r.Bags {
+		colors = append(colors, c)
+	}
+	sort.Strings(colors)
+
+	index := r.index()
+	for _, c := range colors {
+		bag := r.Bags[c]
+		for _, inner := range sortedKeys(bag.Contents) {
+			if _, ok := r.Bags[inner]; !ok {
+				v.Dangling = append(v.Dangling, DanglingRef{c, inner})
+			}
+		}
+
+		if len(bag.Contents) == 0 && len(index[c]) == 0 {
+			v.Unreachable = append(v.Unreachable, c)
+		}
+	}
+
+	// Depth-first search, reporting a cycle for every edge back to a bag
+	// which is still on the stack
+	const (
+		unvisited = iota
+		onStack
+		done
+	)
+	state := make(map[string]int)
+	var stack []string
+
+	var visit func(color string)
+	visit = func(color string) {
+		state[color] = onStack
+		stack = append(stack, color)
+
+		if bag, ok := r.Bags[color]; ok {
+			for _, inner := range sortedKeys(bag.Contents) {
+				switch state[inner] {
+				case unvisited:
+					visit(inner)
+				case onStack:
+					start := len(stack) - 1
+					for stack[start] != inner {
+						start--
+					}
+
+					cycle := append([]string{}, stack[start:]...)
+					v.Cycles = append(v.Cycles, append(cycle, inner))
+				}
+			}
+		}
+
+		stack = stack[:len(stack)-1]
+		state[color] = done
+	}
+
+	for _, c := range colors {
+		if state[c] == unvisited {
+			visit(c)
+		}
+	}
+
+	r.validation = v
+
+	return v
+}
+
+// lookup validates the rules, then finds the bag for color
+func (r *Rules) lookup(color string) (*Bag, error) {
+	if err := r.Validate().Err(); err != nil {
+		return nil, err
+	}
+
+	return r.Bag(color)
+}
+
+// Containers returns the colors of all bags which can eventually contain a
+// bag of the given color, in sorted order. It walks the reverse index
+// once, visiting each containing bag only once. Results are memoized until
+// the next AddBag or Invalidate.
+func (r *Rules) Containers(color string) ([]string, error) {
+	if _, err := r.lookup(color); err != nil {
+		return nil, err
+	}
+
+	index := r.index()
+	if containers, ok := r.containers[color]; ok {
+		return containers, nil
+	}
+
+	seen := map[string]bool{}
+	stack := []string{color}
+	for len(stack) > 0 {
+		inner := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		for outer := range index[inner] {
+			if !seen[outer] {
+				seen[outer] = true
+				stack = append(stack, outer)
+			}
+		}
+	}
+
+	containers := make([]string, 0, len(seen))
+	for c := range seen {
+		containers = append(containers, c)
+	}
+	sort.Strings(containers)
+
+	r.containers[color] = containers
+
+	return containers, nil
+}
+
+// ContentsCount returns the total number of bags inside a bag of the given
+// color. The count for every bag visited is memoized, so each bag's
+// contents are only totalled once across all queries. The memo is cleared
+// by AddBag and Invalidate.
+func (r *Rules) ContentsCount(color string) (int, error) {
+	if _, err := r.lookup(color); err != nil {
+		return 0, err
+	}
+
+	r.index()
+
+	return r.count(color), nil
+}
+
+func (r *Rules) count(color string) int {
+	if num, ok := r.counts[color]; ok {
+		return num
+	}
+
+	num := 0
+	if bag, ok := r.GetColor(color); ok {
+		for inner, n := range bag.Contents {
+			if _, ok := r.GetColor(inner); ok {
+				num += (r.count(inner) + 1) * n
+			}
+		}
+	}
+
+	r.counts[color] = num
+
+	return num
+}
+
+func sortNumberedBags(bags []NumberedBag) {
+	sort.Slice(bags, func(i, j int) bool { return bags[i].Color < bags[j].Color })
+}
+
+// DirectChildren returns the bags which a bag of the given color must
+// directly contain
+func (r *Rules) DirectChildren(color string) ([]NumberedBag, error) {
+	bag, err := r.lookup(color)
+	if err != nil {
+		return nil, err
+	}
+
+	children := make([]NumberedBag, 0, len(bag.Contents))
+	for c, n := range bag.Contents {
+		children = append(children, NumberedBag{Color: c, Count: n})
+	}
+	sortNumberedBags(children)
+
+	return children, nil
+}
+
+// DirectParents returns the bags which directly contain a bag of the given
+// color, and how many of them they contain
+func (r *Rules) DirectParents(color string) ([]NumberedBag, error) {
+	if _, err := r.lookup(color); err != nil {
+		return nil, err
+	}
+
+	parents := make([]NumberedBag, 0)
+	for outer, n := range r.index()[color] {
+		parents = append(parents, NumberedBag{Color: outer, Count: n})
+	}
+	sortNumberedBags(parents)
+
+	return parents, nil
+}
+
+// Path returns the shortest chain of bags from the outer color to the inner
+// one, including both ends
+func (r *Rules) Path(from, to string) ([]string, error) {
+	if _, err := r.lookup(from); err != nil {
+		return nil, err
+	}
+	if _, err := r.lookup(to); err != nil {
+		return nil, err
+	}
+
+	prev := map[string]string{from: ""}
+	queue := []string{from}
+	for len(queue) > 0 {
+		color := queue[0]
+		queue = queue[1:]
+
+		if color == to {
+			path := []string{}
+			for c := to; c != ""; c = prev[c] {
+				path = append([]string{c}, path...)
+			}
+			return path, nil
+		}
+
+		bag, ok := r.GetColor(color)
+		if !ok {
+			continue
+		}
+
+		children := make([]string, 0, len(bag.Contents))
+		for c := range bag.Contents {
+			children = append(children, c)
+		}
+		sort.Strings(children)
+
+		for _, c := range children {
+			if _, seen := prev[c]; !seen {
+				prev[c] = color
+				queue = append(queue, c)
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("%q can't contain %q", from, to)
+}
+
 type NumberedBag struct {
-	Color string
-	Count int
+	Color string `json:"color"`
+	Count int    `json:"count"`
 }
 
 type Bag struct {
@@ -46,39 +445,100 @@ type Bag struct {
 	Contents map[string]int
 }
 
-func (b *Bag) Contains(color string, rules *Rules) bool {
-	if len(b.Contents) == 0 {
-		return false
+// Reachable returns the set of colors reachable from color, including
+// itself. If inward is true, it follows Contents (the bags inside color),
+// otherwise it follows the reverse index (the bags color can be inside).
+// Unlike the queries, it doesn't require the rules to be valid.
+func (r *Rules) Reachable(color string, inward bool) (map[string]bool, error) {
+	if _, err := r.Bag(color); err != nil {
+		return nil, err
 	}
 
-	if _, ok := b.Contents[color]; ok {
-		return true
+	index := r.index()
+
+	seen := map[string]bool{color: true}
+	stack := []string{color}
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		var next map[string]int
+		if inward {
+			if bag, ok := r.GetColor(c); ok {
+				next = bag.Contents
+			}
+		} else {
+			next = index[c]
+		}
+
+		for n := range next {
+			if !seen[n] {
+				seen[n] = true
+				stack = append(stack, n)
+			}
+		}
 	}
 
-	for innerColor := range b.Contents {
-		if b, ok := rules.GetColor(innerColor); ok {
-			if b.Contains(color, rules) {
-				return true
+	return seen, nil
+}
+
+// Adjacency returns the Contents of each bag in include (or all bags, if
+// include is nil), with edges to bags outside include dropped
+func (r *Rules) Adjacency(include map[string]bool) map[string][]NumberedBag {
+	adj := make(map[string][]NumberedBag)
+	for color, bag := range r.Bags {
+		if include != nil && !include[color] {
+			continue
+		}
+
+		contents := make([]NumberedBag, 0, len(bag.Contents))
+		for c, n := range bag.Contents {
+			if include == nil || include[c] {
+				contents = append(contents, NumberedBag{Color: c, Count: n})
 			}
 		}
+		sortNumberedBags(contents)
+
+		adj[color] = contents
 	}
 
-	return false
+	return adj
 }
 
-func (b *Bag) NumContained(rules *Rules) int {
-	if len(b.Contents) == 0 {
-		return 0
+// WriteDOT writes the rules as a Graphviz digraph, with an edge from each
+// bag to each bag it contains, labelled with the count
+func (r *Rules) WriteDOT(w io.Writer, include map[string]bool) error {
+	adj := r.Adjacency(include)
+
+	colors := make([]string, 0, len(adj))
+	for c := range adj {
+		colors = append(colors, c)
 	}
+	sort.Strings(colors)
 
-	num := 0
-	for innerColor, count := range b.Contents {
-		if b, ok := rules.GetColor(innerColor); ok {
-			num += (b.NumContained(rules) + 1) * count
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintln(bw, "digraph bags {")
+	for _, c := range colors {
+		fmt.Fprintf(bw, "\t%q;\n", c)
+	}
+	for _, c := range colors {
+		for _, inner := range adj[c] {
+			fmt.Fprintf(bw, "\t%q -> %q [label=\"%d\"];\n", c, inner.Color, inner.Count)
 		}
 	}
+	fmt.Fprintln(bw, "}")
 
-	return num
+	return bw.Flush()
+}
+
+// WriteJSON writes the rules as a JSON object mapping each color to the
+// list of bags it contains
+func (r *Rules) WriteJSON(w io.Writer, include map[string]bool) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+
+	return enc.Encode(r.Adjacency(include))
 }
 
 func parseBagColor(color string) (string, error) {
@@ -148,50 +608,145 @@ func NewBag(rule string) (*Bag, error) {
 	return &bag, nil
 }
 
-func run() error {
-	if len(os.Args) != 2 {
-		return fmt.Errorf("Usage: %s INPUT", os.Args[0])
+func printValidation(v *ValidationReport) {
+	fmt.Println("Cycles:", len(v.Cycles))
+	for _, c := range v.Cycles {
+		fmt.Println("  ", strings.Join(c, " -> "))
 	}
 
-	f, err := os.Open(os.Args[1])
-	if err != nil {
-		return err
+	fmt.Println("Dangling references:", len(v.Dangling))
+	for _, d := range v.Dangling {
+		fmt.Printf("   %s contains undefined %s\n", d.Bag, d.Missing)
 	}
-	defer f.Close()
 
-	rules := &Rules{
-		Bags: make(map[string]*Bag, 0),
+	fmt.Println("Duplicate definitions:", len(v.Duplicates))
+	for _, d := range v.Duplicates {
+		fmt.Println("  ", d)
 	}
 
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := scanner.Text()
+	fmt.Println("Unreachable bags:", len(v.Unreachable))
+	for _, u := range v.Unreachable {
+		fmt.Println("  ", u)
+	}
+}
 
-		bag, err := NewBag(line)
+func runQuery(rules *Rules, color string, query []string) error {
+	switch query[0] {
+	case "validate":
+		v := rules.Validate()
+		printValidation(v)
+		return v.Err()
+	case "containers":
+		containers, err := rules.Containers(color)
 		if err != nil {
 			return err
 		}
 
-		rules.AddBag(bag)
+		for _, c := range containers {
+			fmt.Println(c)
+		}
+		fmt.Printf("Number that can contain %s: %d\n", color, len(containers))
+	case "contents-count":
+		num, err := rules.ContentsCount(color)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Number that %s must contain: %d\n", color, num)
+	case "direct-children":
+		children, err := rules.DirectChildren(color)
+		if err != nil {
+			return err
+		}
+
+		for _, b := range children {
+			fmt.Println(b.Count, b.Color)
+		}
+	case "direct-parents":
+		parents, err := rules.DirectParents(color)
+		if err != nil {
+			return err
+		}
+
+		for _, b := range parents {
+			fmt.Println(b.Color, "contains", b.Count)
+		}
+	case "dot", "json":
+		var include map[string]bool
+		if len(query) > 1 {
+			if query[1] != "from" && query[1] != "to" {
+				return fmt.Errorf("Usage: %s [from|to]", query[0])
+			}
+
+			var err error
+			include, err = rules.Reachable(color, query[1] == "from")
+			if err != nil {
+				return err
+			}
+		}
+
+		if query[0] == "dot" {
+			return rules.WriteDOT(os.Stdout, include)
+		}
+		return rules.WriteJSON(os.Stdout, include)
+	case "path":
+		if len(query) != 3 {
+			return fmt.Errorf("Usage: path FROM TO")
+		}
+
+		path, err := rules.Path(query[1], query[2])
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(strings.Join(path, " -> "))
+	default:
+		return fmt.Errorf("unknown query: %s", query[0])
 	}
 
-	if err := scanner.Err(); err != nil {
+	return nil
+}
+
+func run() error {
+	color := flag.String("bag", "shiny gold", "bag color to query")
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		return fmt.Errorf("Usage: %s [--bag COLOR] INPUT [QUERY]\n"+
+			"Queries: containers, contents-count, direct-children, direct-parents, path FROM TO, validate\n"+
+			"Exports: dot [from|to], json [from|to]", os.Args[0])
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rules, err := ParseRules(f)
+	if err != nil {
 		return err
 	}
 
+	if flag.NArg() > 1 {
+		return runQuery(rules, *color, flag.Args()[1:])
+	}
+
 	fmt.Println("Parsed", len(rules.Bags))
 
-	numContain := 0
-	for _, outer := range rules.Bags {
-		if outer.Contains("shiny gold", rules) {
-			numContain++
-		}
+	containers, err := rules.Containers(*color)
+	if err != nil {
+		return err
 	}
 
-	fmt.Println("Number that can contain shiny gold:", numContain)
+	fmt.Printf("Number that can contain %s: %d\n", *color, len(containers))
+
+	num, err := rules.ContentsCount(*color)
+	if err != nil {
+		return err
+	}
 
-	shinyGold, _ := rules.GetColor("shiny gold")
-	fmt.Println("Number that shiny gold must contain:", shinyGold.NumContained(rules))
+	fmt.Printf("Number that %s must contain: %d\n", *color, num)
 
 	return nil
 }
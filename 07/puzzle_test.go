@@ -1,6 +1,9 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -151,6 +154,45 @@ func TestParseBag(t *testing.T) {
 	}
 }
 
+// contains and numContained are the original recursive queries, which
+// Rules.Containers and Rules.ContentsCount replaced. They're kept as
+// oracles for those, but they don't terminate on cyclic rules, and
+// contains takes exponential time.
+func (b *Bag) contains(color string, rules *Rules) bool {
+	if len(b.Contents) == 0 {
+		return false
+	}
+
+	if _, ok := b.Contents[color]; ok {
+		return true
+	}
+
+	for innerColor := range b.Contents {
+		if b, ok := rules.GetColor(innerColor); ok {
+			if b.contains(color, rules) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (b *Bag) numContained(rules *Rules) int {
+	if len(b.Contents) == 0 {
+		return 0
+	}
+
+	num := 0
+	for innerColor, count := range b.Contents {
+		if b, ok := rules.GetColor(innerColor); ok {
+			num += (b.numContained(rules) + 1) * count
+		}
+	}
+
+	return num
+}
+
 func TestContains(t *testing.T) {
 	white := &Bag{
 		Color: "bright white",
@@ -172,18 +214,18 @@ func TestContains(t *testing.T) {
 	}
 
 	color := "light red"
-	res := white.Contains(color, rules)
+	res := white.contains(color, rules)
 	if res {
 		t.Errorf("%#v contains %s: %v", *white, color, res)
 	}
 
 	yellow.Contents["light red"] = 7
-	res = yellow.Contains(color, rules)
+	res = yellow.contains(color, rules)
 	if !res {
 		t.Errorf("%#v contains %s: %v", *white, color, res)
 	}
 
-	res = white.Contains(color, rules)
+	res = white.contains(color, rules)
 	if !res {
 		t.Errorf("%#v contains %s: %v", *white, color, res)
 	}
@@ -215,24 +257,467 @@ func TestNumContained(t *testing.T) {
 		},
 	}
 
-	num := white.NumContained(rules)
+	num := white.numContained(rules)
 	if num != 1 {
 		t.Errorf("%#v numContained: %v", *white, num)
 	}
 
-	num = yellow.NumContained(rules)
+	num = yellow.numContained(rules)
 	if num != 0 {
 		t.Errorf("%#v numContained: %v", *yellow, num)
 	}
 
 	yellow.Contents["light red"] = 7
-	num = white.NumContained(rules)
+	num = white.numContained(rules)
 	if num != 8 {
 		t.Errorf("%#v numContained: %v", *white, num)
 	}
 
-	num = yellow.NumContained(rules)
+	num = yellow.numContained(rules)
 	if num != 7 {
 		t.Errorf("%#v numContained: %v", *yellow, num)
 	}
 }
+
+var exampleRules = `light red bags contain 1 bright white bag, 2 muted yellow bags.
+dark orange bags contain 3 bright white bags, 4 muted yellow bags.
+bright white bags contain 1 shiny gold bag.
+muted yellow bags contain 2 shiny gold bags, 9 faded blue bags.
+shiny gold bags contain 1 dark olive bag, 2 vibrant plum bags.
+dark olive bags contain 3 faded blue bags, 4 dotted black bags.
+vibrant plum bags contain 5 faded blue bags, 6 dotted black bags.
+faded blue bags contain no other bags.
+dotted black bags contain no other bags.
+`
+
+func parseExampleRules(t *testing.T) *Rules {
+	rules, err := ParseRules(strings.NewReader(exampleRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rules
+}
+
+func TestQueries(t *testing.T) {
+	rules := parseExampleRules(t)
+
+	containers, err := rules.Containers("shiny gold")
+	if err != nil {
+		t.Error(err)
+	} else if strings.Join(containers, ",") != "bright white,dark orange,light red,muted yellow" {
+		t.Errorf("containers: %v", containers)
+	}
+
+	num, err := rules.ContentsCount("shiny gold")
+	if err != nil {
+		t.Error(err)
+	} else if num != 32 {
+		t.Errorf("contents-count: %v", num)
+	}
+
+	children, err := rules.DirectChildren("muted yellow")
+	if err != nil {
+		t.Error(err)
+	} else if len(children) != 2 || children[0] != (NumberedBag{"faded blue", 9}) || children[1] != (NumberedBag{"shiny gold", 2}) {
+		t.Errorf("direct-children: %v", children)
+	}
+
+	parents, err := rules.DirectParents("shiny gold")
+	if err != nil {
+		t.Error(err)
+	} else if len(parents) != 2 || parents[0] != (NumberedBag{"bright white", 1}) || parents[1] != (NumberedBag{"muted yellow", 2}) {
+		t.Errorf("direct-parents: %v", parents)
+	}
+
+	path, err := rules.Path("light red", "dotted black")
+	if err != nil {
+		t.Error(err)
+	} else if strings.Join(path, ",") != "light red,bright white,shiny gold,dark olive,dotted black" {
+		t.Errorf("path: %v", path)
+	}
+
+	if _, err := rules.Path("faded blue", "shiny gold"); err == nil {
+		t.Errorf("path: expected error for impossible path")
+	}
+}
+
+func TestUnknownColor(t *testing.T) {
+	rules := parseExampleRules(t)
+
+	if _, err := rules.Containers("plaid green"); err == nil {
+		t.Errorf("containers: expected error")
+	}
+
+	if _, err := rules.ContentsCount("plaid green"); err == nil {
+		t.Errorf("contents-count: expected error")
+	}
+
+	if _, err := rules.DirectChildren("plaid green"); err == nil {
+		t.Errorf("direct-children: expected error")
+	}
+
+	if _, err := rules.DirectParents("plaid green"); err == nil {
+		t.Errorf("direct-parents: expected error")
+	}
+
+	if _, err := rules.Path("shiny gold", "plaid green"); err == nil {
+		t.Errorf("path: expected error")
+	}
+}
+
+func TestMemoizedMatchesRecursive(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader(generateRules(20, 3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for color, bag := range rules.Bags {
+		num, err := rules.ContentsCount(color)
+		if err != nil {
+			t.Fatal(err)
+		} else if num != bag.numContained(rules) {
+			t.Errorf("%s: memoized count %d, recursive %d", color, num, bag.numContained(rules))
+		}
+	}
+
+	for color := range rules.Bags {
+		containers, err := rules.Containers(color)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		numContain := 0
+		for _, outer := range rules.Bags {
+			if outer.contains(color, rules) {
+				numContain++
+			}
+		}
+
+		if len(containers) != numContain {
+			t.Errorf("%s: indexed containers %d, recursive %d", color, len(containers), numContain)
+		}
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	rules := parseExampleRules(t)
+
+	if num, _ := rules.ContentsCount("faded blue"); num != 0 {
+		t.Errorf("expected 0 got %d", num)
+	}
+
+	rules.Bags["faded blue"].Contents["dotted black"] = 2
+	rules.Invalidate()
+
+	if num, _ := rules.ContentsCount("faded blue"); num != 2 {
+		t.Errorf("expected 2 got %d", num)
+	}
+
+	if containers, _ := rules.Containers("dotted black"); len(containers) != 8 {
+		t.Errorf("expected 8 containers got %v", containers)
+	}
+}
+
+// colorName produces a unique two-word color for any non-negative i
+func colorName(i int) string {
+	word := []byte{}
+	for {
+		word = append(word, byte('a'+i%26))
+		i /= 26
+		if i == 0 {
+			break
+		}
+	}
+
+	return "shade " + string(word)
+}
+
+// generateRules builds a layered DAG of n colors, where each bag contains
+// up to fanout bags from the next few colors. Every path down the DAG is
+// long and shares most of its subtrees, which is the worst case for a
+// naive recursive search.
+func generateRules(n, fanout int) string {
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		sb.WriteString(colorName(i) + " bags contain ")
+
+		var contents []string
+		for j := 1; j <= fanout && i+j < n; j++ {
+			contents = append(contents, fmt.Sprintf("%d %s bags", j, colorName(i+j)))
+		}
+
+		if len(contents) == 0 {
+			sb.WriteString("no other bags.\n")
+		} else {
+			sb.WriteString(strings.Join(contents, ", ") + ".\n")
+		}
+	}
+
+	return sb.String()
+}
+
+func benchmarkRules(b *testing.B, n int) *Rules {
+	rules, err := ParseRules(strings.NewReader(generateRules(n, 3)))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return rules
+}
+
+// The recursive searches are exponential in the depth of the DAG, so only
+// the smaller sizes are run for them. Counts overflow for the bigger sizes,
+// which doesn't matter for timing.
+var benchSizes = []int{16, 24, 1000, 5000}
+
+const maxRecursiveSize = 24
+
+func BenchmarkContainers(b *testing.B) {
+	for _, n := range benchSizes {
+		rules := benchmarkRules(b, n)
+
+		// Everything contains the leaf, so the indexed search visits every
+		// bag. Nothing contains the root, so the recursive search can't
+		// return early.
+		targets := map[string]string{
+			"leaf": colorName(n - 1),
+			"root": colorName(0),
+		}
+
+		for _, name := range []string{"leaf", "root"} {
+			target := targets[name]
+
+			b.Run(fmt.Sprintf("indexed-%s-%d", name, n), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					// Keep the index, which is built at parse time
+					rules.containers = make(map[string][]string)
+					if _, err := rules.Containers(target); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+
+			if n > maxRecursiveSize {
+				continue
+			}
+
+			b.Run(fmt.Sprintf("recursive-%s-%d", name, n), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					for _, outer := range rules.Bags {
+						outer.contains(target, rules)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkContentsCount(b *testing.B) {
+	for _, n := range benchSizes {
+		rules := benchmarkRules(b, n)
+		root := colorName(0)
+
+		b.Run(fmt.Sprintf("memoized-%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				rules.counts = make(map[string]int)
+				if _, err := rules.ContentsCount(root); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		if n > maxRecursiveSize {
+			continue
+		}
+
+		b.Run(fmt.Sprintf("recursive-%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				rules.Bags[root].numContained(rules)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	rules := parseExampleRules(t)
+
+	v := rules.Validate()
+	if err := v.Err(); err != nil {
+		t.Error(err)
+	}
+
+	if len(v.Unreachable) != 0 {
+		t.Errorf("unexpected unreachable bags: %v", v.Unreachable)
+	}
+}
+
+func TestValidateCycle(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader(exampleRules +
+		"dotted black bags contain 1 light red bag.\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := rules.Validate()
+	if v.Err() == nil {
+		t.Fatalf("expected error for cycle")
+	}
+
+	if len(v.Cycles) == 0 {
+		t.Fatalf("expected cycles")
+	}
+
+	// Every cycle must start and end with the same bag, and follow
+	// Contents at each step
+	for _, c := range v.Cycles {
+		if c[0] != c[len(c)-1] {
+			t.Errorf("cycle doesn't close: %v", c)
+		}
+
+		for i := 0; i < len(c)-1; i++ {
+			if _, ok := rules.Bags[c[i]].Contents[c[i+1]]; !ok {
+				t.Errorf("%v: %s doesn't contain %s", c, c[i], c[i+1])
+			}
+		}
+	}
+
+	// Queries must fail rather than recurse forever
+	if _, err := rules.ContentsCount("shiny gold"); err == nil {
+		t.Errorf("contents-count: expected error")
+	}
+
+	if _, err := rules.Containers("shiny gold"); err == nil {
+		t.Errorf("containers: expected error")
+	}
+}
+
+func TestValidateSelfCycle(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader("shiny gold bags contain 2 shiny gold bags.\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := rules.Validate()
+	if len(v.Cycles) != 1 || strings.Join(v.Cycles[0], ",") != "shiny gold,shiny gold" {
+		t.Errorf("unexpected cycles: %v", v.Cycles)
+	}
+}
+
+func TestValidateDangling(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader(exampleRules +
+		"plaid green bags contain 1 shiny gold bag, 3 wavy pink bags.\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := rules.Validate()
+	if len(v.Dangling) != 1 || v.Dangling[0] != (DanglingRef{"plaid green", "wavy pink"}) {
+		t.Errorf("unexpected dangling references: %v", v.Dangling)
+	}
+
+	if _, err := rules.DirectChildren("plaid green"); err == nil {
+		t.Errorf("direct-children: expected error")
+	}
+}
+
+func TestValidateDuplicate(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader(exampleRules +
+		"faded blue bags contain 1 dotted black bag.\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := rules.Validate()
+	if len(v.Duplicates) != 1 || v.Duplicates[0] != "faded blue" {
+		t.Errorf("unexpected duplicates: %v", v.Duplicates)
+	}
+
+	if v.Err() == nil {
+		t.Errorf("expected error for duplicate")
+	}
+}
+
+func TestValidateUnreachable(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader(exampleRules +
+		"plaid green bags contain no other bags.\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := rules.Validate()
+	if len(v.Unreachable) != 1 || v.Unreachable[0] != "plaid green" {
+		t.Errorf("unexpected unreachable bags: %v", v.Unreachable)
+	}
+
+	// Unreachable bags are harmless
+	if err := v.Err(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWriteDOT(t *testing.T) {
+	rules := parseExampleRules(t)
+
+	include, err := rules.Reachable("shiny gold", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sb strings.Builder
+	if err := rules.WriteDOT(&sb, include); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `digraph bags {
+	"dark olive";
+	"dotted black";
+	"faded blue";
+	"shiny gold";
+	"vibrant plum";
+	"dark olive" -> "dotted black" [label="4"];
+	"dark olive" -> "faded blue" [label="3"];
+	"shiny gold" -> "dark olive" [label="1"];
+	"shiny gold" -> "vibrant plum" [label="2"];
+	"vibrant plum" -> "dotted black" [label="6"];
+	"vibrant plum" -> "faded blue" [label="5"];
+}
+`
+	if sb.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, sb.String())
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	rules := parseExampleRules(t)
+
+	include, err := rules.Reachable("shiny gold", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sb strings.Builder
+	if err := rules.WriteJSON(&sb, include); err != nil {
+		t.Fatal(err)
+	}
+
+	var adj map[string][]NumberedBag
+	if err := json.Unmarshal([]byte(sb.String()), &adj); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(adj) != 5 {
+		t.Errorf("expected 5 bags got %v", adj)
+	}
+
+	white := adj["bright white"]
+	if len(white) != 1 || white[0] != (NumberedBag{"shiny gold", 1}) {
+		t.Errorf("bright white: %v", white)
+	}
+
+	// Edges out of the subgraph are dropped
+	yellow := adj["muted yellow"]
+	if len(yellow) != 1 || yellow[0] != (NumberedBag{"shiny gold", 2}) {
+		t.Errorf("muted yellow: %v", yellow)
+	}
+}
@@ -2,8 +2,12 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -12,135 +16,1868 @@ type VM struct {
 	PC          int
 	Accumulator int
 	Breakpoint  func(*VM, *Instruction) bool
+
+	// Registers holds every register other than "acc", which is
+	// Accumulator. Registers which have never been written read as 0.
+	Registers map[string]int
+
+	// Input and Output are used by the "in" and "out" instructions
+	Input  <-chan int
+	Output chan<- int
+
+	// Err is set if an instruction fails, which stops Execute
+	Err error
+}
+
+func (vm *VM) Reset() {
+	vm.PC = 0
+	vm.Accumulator = 0
+	vm.Registers = nil
+	vm.Err = nil
+}
+
+func (vm *VM) Reg(name string) int {
+	if name == "acc" {
+		return vm.Accumulator
+	}
+
+	return vm.Registers[name]
+}
+
+func (vm *VM) SetReg(name string, val int) {
+	if name == "acc" {
+		vm.Accumulator = val
+		return
+	}
+
+	if vm.Registers == nil {
+		vm.Registers = make(map[string]int)
+	}
+	vm.Registers[name] = val
+}
+
+func (vm *VM) Execute(program *Program) bool {
+	normalTermination := true
+	for vm.PC < len(program.Instructions) {
+		if vm.PC < 0 {
+			// Jumped off the front of the program
+			normalTermination = false
+			break
+		}
+
+		insn := program.Instructions[vm.PC]
+		if vm.Breakpoint != nil && vm.Breakpoint(vm, &insn) {
+			normalTermination = false
+			break
+		}
+
+		if err := insn.Execute(vm); err != nil {
+			vm.Err = fmt.Errorf("pc %d: %v", vm.PC, err)
+			normalTermination = false
+			break
+		}
+	}
+
+	return normalTermination
+}
+
+// VMSnapshot is the state of a VM at some point in its execution, and
+// optionally of the Tracer watching it
+type VMSnapshot struct {
+	PC, Accumulator int
+	Registers       map[string]int
+
+	// Tracer is rewound when the snapshot is restored, if it's set
+	Tracer     *Tracer
+	tracerMark int
+}
+
+func copyRegisters(regs map[string]int) map[string]int {
+	if regs == nil {
+		return nil
+	}
+
+	c := make(map[string]int, len(regs))
+	for k, v := range regs {
+		c[k] = v
+	}
+	return c
+}
+
+func (vm *VM) Snapshot() VMSnapshot {
+	return VMSnapshot{
+		PC:          vm.PC,
+		Accumulator: vm.Accumulator,
+		Registers:   copyRegisters(vm.Registers),
+	}
+}
+
+// SnapshotWith takes a snapshot which also records the state of tracer
+func (vm *VM) SnapshotWith(tracer *Tracer) VMSnapshot {
+	s := vm.Snapshot()
+	s.Tracer = tracer
+	s.tracerMark = tracer.Mark()
+
+	return s
+}
+
+// Restore returns the VM, and its tracer if the snapshot has one, to a
+// snapshot, which can be restored again later
+func (vm *VM) Restore(s VMSnapshot) error {
+	if s.Tracer != nil {
+		if err := s.Tracer.Rewind(s.tracerMark); err != nil {
+			return err
+		}
+	}
+
+	vm.PC = s.PC
+	vm.Accumulator = s.Accumulator
+	vm.Registers = copyRegisters(s.Registers)
+	vm.Err = nil
+
+	return nil
+}
+
+// MaxOperands is the most operands any instruction can have
+const MaxOperands = 3
+
+// Operand is a register (if Reg is set) or an immediate value
+type Operand struct {
+	Reg string
+	Imm int
+}
+
+func (o Operand) Value(vm *VM) int {
+	if o.Reg != "" {
+		return vm.Reg(o.Reg)
+	}
+	return o.Imm
+}
+
+func (o Operand) String() string {
+	if o.Reg != "" {
+		return o.Reg
+	}
+	return fmt.Sprintf("%+d", o.Imm)
+}
+
+// Instruction is an opcode and its operands. The first operand is Arg,
+// or the register Reg if that's set, and any others are in More. The
+// original instructions only ever use Arg.
+type Instruction struct {
+	Opcode string
+	Arg    int
+	Reg    string
+	More   [MaxOperands - 1]Operand
+}
+
+func (insn *Instruction) Operand(i int) Operand {
+	if i == 0 {
+		return Operand{Reg: insn.Reg, Imm: insn.Arg}
+	}
+	return insn.More[i-1]
+}
+
+func (insn *Instruction) SetOperand(i int, o Operand) {
+	if i == 0 {
+		insn.Reg, insn.Arg = o.Reg, o.Imm
+		return
+	}
+	insn.More[i-1] = o
+}
+
+func (insn Instruction) Execute(on *VM) error {
+	def, ok := opcodes[insn.Opcode]
+	if !ok {
+		return fmt.Errorf("unknown opcode: %s", insn.Opcode)
+	}
+
+	return def.Exec(on, &insn)
+}
+
+func (insn Instruction) String() string {
+	if def, ok := opcodes[insn.Opcode]; ok && (len(def.Operands) > 1 || insn.Reg != "") {
+		return insn.Source()
+	}
+
+	return fmt.Sprintf("%s %d", insn.Opcode, insn.Arg)
+}
+
+// Source returns insn as assembler source, with relative jump targets
+func (insn Instruction) Source() string {
+	def, ok := opcodes[insn.Opcode]
+	if !ok {
+		return fmt.Sprintf("%s %+d", insn.Opcode, insn.Arg)
+	}
+
+	s := insn.Opcode
+	for i := range def.Operands {
+		s += " " + insn.Operand(i).String()
+	}
+
+	return s
+}
+
+// OperandKind is a bitmask of the kinds of operand which an instruction
+// accepts in each position
+type OperandKind int
+
+const (
+	// An immediate integer
+	OperandImm OperandKind = 1 << iota
+	// A register name
+	OperandReg
+	// A jump offset, relative to the instruction. The assembler accepts
+	// a label here.
+	OperandTarget
+)
+
+// OpcodeDef defines the operands and semantics of an instruction. Exec
+// must update the VM's PC.
+type OpcodeDef struct {
+	Name     string
+	Operands []OperandKind
+	Exec     func(vm *VM, insn *Instruction) error
+}
+
+var opcodes = make(map[string]*OpcodeDef)
+
+// identRE matches register and label names
+var identRE *regexp.Regexp = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+func RegisterOpcode(def *OpcodeDef) {
+	if _, ok := opcodes[def.Name]; ok {
+		panic("duplicate opcode: " + def.Name)
+	}
+
+	if len(def.Operands) > MaxOperands {
+		panic("too many operands: " + def.Name)
+	}
+
+	opcodes[def.Name] = def
+}
+
+func init() {
+	// The original instruction set
+	RegisterOpcode(&OpcodeDef{
+		Name:     "acc",
+		Operands: []OperandKind{OperandImm},
+		Exec: func(vm *VM, insn *Instruction) error {
+			vm.Accumulator += insn.Arg
+			vm.PC += 1
+			return nil
+		},
+	})
+	RegisterOpcode(&OpcodeDef{
+		Name:     "jmp",
+		Operands: []OperandKind{OperandTarget},
+		Exec: func(vm *VM, insn *Instruction) error {
+			vm.PC += insn.Arg
+			return nil
+		},
+	})
+	// nop's argument is a target, because patching it to a jmp makes it one
+	RegisterOpcode(&OpcodeDef{
+		Name:     "nop",
+		Operands: []OperandKind{OperandTarget},
+		Exec: func(vm *VM, insn *Instruction) error {
+			vm.PC += 1
+			return nil
+		},
+	})
+
+	// Registers
+	RegisterOpcode(&OpcodeDef{
+		Name:     "set",
+		Operands: []OperandKind{OperandReg, OperandImm | OperandReg},
+		Exec: func(vm *VM, insn *Instruction) error {
+			vm.SetReg(insn.Reg, insn.Operand(1).Value(vm))
+			vm.PC += 1
+			return nil
+		},
+	})
+	RegisterOpcode(&OpcodeDef{
+		Name:     "add",
+		Operands: []OperandKind{OperandReg, OperandImm | OperandReg},
+		Exec: func(vm *VM, insn *Instruction) error {
+			vm.SetReg(insn.Reg, vm.Reg(insn.Reg)+insn.Operand(1).Value(vm))
+			vm.PC += 1
+			return nil
+		},
+	})
+	RegisterOpcode(&OpcodeDef{
+		Name:     "mul",
+		Operands: []OperandKind{OperandReg, OperandImm | OperandReg},
+		Exec: func(vm *VM, insn *Instruction) error {
+			vm.SetReg(insn.Reg, vm.Reg(insn.Reg)*insn.Operand(1).Value(vm))
+			vm.PC += 1
+			return nil
+		},
+	})
+
+	// Conditional jumps
+	RegisterOpcode(&OpcodeDef{
+		Name:     "jz",
+		Operands: []OperandKind{OperandImm | OperandReg, OperandTarget},
+		Exec: func(vm *VM, insn *Instruction) error {
+			if insn.Operand(0).Value(vm) == 0 {
+				vm.PC += insn.More[0].Imm
+			} else {
+				vm.PC += 1
+			}
+			return nil
+		},
+	})
+	RegisterOpcode(&OpcodeDef{
+		Name:     "jnz",
+		Operands: []OperandKind{OperandImm | OperandReg, OperandTarget},
+		Exec: func(vm *VM, insn *Instruction) error {
+			if insn.Operand(0).Value(vm) != 0 {
+				vm.PC += insn.More[0].Imm
+			} else {
+				vm.PC += 1
+			}
+			return nil
+		},
+	})
+
+	// I/O
+	RegisterOpcode(&OpcodeDef{
+		Name:     "in",
+		Operands: []OperandKind{OperandReg},
+		Exec: func(vm *VM, insn *Instruction) error {
+			if vm.Input == nil {
+				return fmt.Errorf("no input")
+			}
+
+			val, ok := <-vm.Input
+			if !ok {
+				return fmt.Errorf("end of input")
+			}
+
+			vm.SetReg(insn.Reg, val)
+			vm.PC += 1
+			return nil
+		},
+	})
+	RegisterOpcode(&OpcodeDef{
+		Name:     "out",
+		Operands: []OperandKind{OperandImm | OperandReg},
+		Exec: func(vm *VM, insn *Instruction) error {
+			if vm.Output == nil {
+				return fmt.Errorf("no output")
+			}
+
+			vm.Output <- insn.Operand(0).Value(vm)
+			vm.PC += 1
+			return nil
+		},
+	})
+}
+
+// parseOperand parses a number or register name. If kind accepts a target,
+// resolve is called to look up names as labels, and should return false if
+// there's no such label.
+func parseOperand(s string, kind OperandKind, resolve func(label string) (int, bool)) (Operand, error) {
+	if v, err := strconv.Atoi(s); err == nil {
+		if kind&(OperandImm|OperandTarget) == 0 {
+			return Operand{}, fmt.Errorf("expected a register, got %s", s)
+		}
+		return Operand{Imm: v}, nil
+	}
+
+	if !identRE.MatchString(s) {
+		return Operand{}, fmt.Errorf("invalid operand: %s", s)
+	}
+
+	if kind&OperandTarget != 0 {
+		if resolve != nil {
+			if v, ok := resolve(s); ok {
+				return Operand{Imm: v}, nil
+			}
+		}
+		return Operand{}, fmt.Errorf("undefined label: %s", s)
+	}
+
+	if kind&OperandReg == 0 {
+		return Operand{}, fmt.Errorf("expected a number, got %s", s)
+	}
+
+	if s == "pc" {
+		return Operand{}, fmt.Errorf("pc can't be used as a register")
+	}
+
+	return Operand{Reg: s}, nil
+}
+
+// parseFields builds an instruction from an opcode and its operands
+func parseFields(fields []string, resolve func(label string) (int, bool)) (Instruction, error) {
+	def, ok := opcodes[fields[0]]
+	if !ok {
+		return Instruction{}, fmt.Errorf("unknown opcode: %s", fields[0])
+	}
+
+	if len(fields)-1 != len(def.Operands) {
+		return Instruction{}, fmt.Errorf("%s takes %d operands, got %d", def.Name, len(def.Operands), len(fields)-1)
+	}
+
+	insn := Instruction{Opcode: def.Name}
+	for i, kind := range def.Operands {
+		o, err := parseOperand(fields[i+1], kind, resolve)
+		if err != nil {
+			return Instruction{}, err
+		}
+		insn.SetOperand(i, o)
+	}
+
+	return insn, nil
+}
+
+func ParseInstruction(s string) (Instruction, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return Instruction{}, fmt.Errorf("couldn't parse instruction parts: %s", s)
+	}
+
+	return parseFields(fields, nil)
+}
+
+type Program struct {
+	Instructions []Instruction
+}
+
+// Registers returns the names of every register the program uses, and
+// "acc", which always exists
+func (p *Program) Registers() map[string]bool {
+	regs := map[string]bool{"acc": true}
+	for i := range p.Instructions {
+		insn := &p.Instructions[i]
+		for j := 0; j < MaxOperands; j++ {
+			if r := insn.Operand(j).Reg; r != "" {
+				regs[r] = true
+			}
+		}
+	}
+
+	return regs
+}
+
+type asmLine struct {
+	lineNo int
+	fields []string
+}
+
+// Assemble reads program source, which is like the puzzle input with some
+// additions:
+//   - Comments start with ';' or '#' and run to the end of the line
+//   - A line may start with one or more "label:" definitions
+//   - Jump target operands may be a label instead of a relative offset
+func Assemble(r io.Reader) (*Program, error) {
+	labels := make(map[string]int)
+	lines := make([]asmLine, 0)
+
+	lineNo := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+
+		if i := strings.IndexAny(line, ";#"); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		for len(fields) > 0 && strings.HasSuffix(fields[0], ":") {
+			label := strings.TrimSuffix(fields[0], ":")
+			if !identRE.MatchString(label) {
+				return nil, fmt.Errorf("line %d: invalid label: %q", lineNo, label)
+			}
+
+			if _, ok := labels[label]; ok {
+				return nil, fmt.Errorf("line %d: duplicate label: %s", lineNo, label)
+			}
+
+			labels[label] = len(lines)
+			fields = fields[1:]
+		}
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		if _, ok := opcodes[fields[0]]; !ok {
+			return nil, fmt.Errorf("line %d: unknown opcode: %s", lineNo, fields[0])
+		}
+
+		lines = append(lines, asmLine{lineNo, fields})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	program := &Program{
+		Instructions: make([]Instruction, 0, len(lines)),
+	}
+
+	for addr, l := range lines {
+		resolve := func(label string) (int, bool) {
+			target, ok := labels[label]
+			return target - addr, ok
+		}
+
+		insn, err := parseFields(l.fields, resolve)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", l.lineNo, err)
+		}
+
+		program.Instructions = append(program.Instructions, insn)
+	}
+
+	return program, nil
+}
+
+// Disassemble writes program as assembler source. Every in-range jump
+// target gets a label ("L<address>", or "end" for the address just past
+// the last instruction), and jump operands refer to them. nop +0 is left
+// alone, as it's almost never meant as a jump.
+func Disassemble(w io.Writer, program *Program) error {
+	n := len(program.Instructions)
+
+	labelFor := func(addr int) string {
+		if addr == n {
+			return "end"
+		}
+		return fmt.Sprintf("L%d", addr)
+	}
+
+	// Calls f for each target operand which should be shown as a label
+	forTargets := func(addr int, insn *Instruction, f func(i, target int)) {
+		def, ok := opcodes[insn.Opcode]
+		if !ok {
+			return
+		}
+
+		for i, kind := range def.Operands {
+			target := addr + insn.Operand(i).Imm
+			if kind&OperandTarget == 0 || target < 0 || target > n {
+				continue
+			}
+
+			if insn.Opcode == "nop" && target == addr {
+				continue
+			}
+
+			f(i, target)
+		}
+	}
+
+	targets := make(map[int]bool)
+	for addr := range program.Instructions {
+		forTargets(addr, &program.Instructions[addr], func(i, target int) {
+			targets[target] = true
+		})
+	}
+
+	bw := bufio.NewWriter(w)
+	for addr := range program.Instructions {
+		insn := &program.Instructions[addr]
+
+		if targets[addr] {
+			fmt.Fprintf(bw, "%s:\n", labelFor(addr))
+		}
+
+		operands := make([]string, 0, MaxOperands)
+		if def, ok := opcodes[insn.Opcode]; ok {
+			for i := range def.Operands {
+				operands = append(operands, insn.Operand(i).String())
+			}
+		} else {
+			operands = append(operands, fmt.Sprintf("%+d", insn.Arg))
+		}
+
+		forTargets(addr, insn, func(i, target int) {
+			operands[i] = labelFor(target)
+		})
+
+		fmt.Fprintf(bw, "\t%s %s\n", insn.Opcode, strings.Join(operands, " "))
+	}
+
+	if targets[n] {
+		fmt.Fprintf(bw, "%s:\n", labelFor(n))
+	}
+
+	return bw.Flush()
+}
+
+// bytecodeOp is a compiled opcode. The original instructions have their
+// own, and everything else goes through the registry.
+type bytecodeOp uint8
+
+const (
+	bcNop bytecodeOp = iota
+	bcAcc
+	bcJmp
+	bcGeneric
+)
+
+type bytecodeInsn struct {
+	op  bytecodeOp
+	arg int
+}
+
+// Bytecode is a Program lowered to numeric opcodes, so that executing it
+// doesn't compare strings or copy Instructions
+type Bytecode struct {
+	Program *Program
+	code    []bytecodeInsn
+	// insns is the program as compiled, for the bcGeneric instructions,
+	// so that patching Program afterwards doesn't mix old and new code
+	insns []Instruction
+}
+
+func Compile(program *Program) *Bytecode {
+	bc := &Bytecode{
+		Program: program,
+		code:    make([]bytecodeInsn, len(program.Instructions)),
+		insns:   append([]Instruction(nil), program.Instructions...),
+	}
+
+	for i, insn := range program.Instructions {
+		c := bytecodeInsn{op: bcGeneric, arg: insn.Arg}
+		switch insn.Opcode {
+		case "nop":
+			c.op = bcNop
+		case "acc":
+			c.op = bcAcc
+		case "jmp":
+			c.op = bcJmp
+		}
+		bc.code[i] = c
+	}
+
+	return bc
+}
+
+// Execute runs the program on vm until it terminates, returning true for
+// normal termination. If detectLoops is set, it stops before any
+// instruction would run a second time, like Tracer, and returns false.
+// vm.Breakpoint is ignored.
+func (bc *Bytecode) Execute(vm *VM, detectLoops bool) bool {
+	code := bc.code
+	n := len(code)
+
+	var visited []uint64
+	if detectLoops {
+		visited = make([]uint64, (n+63)/64)
+	}
+
+	pc, acc := vm.PC, vm.Accumulator
+	for pc < n {
+		if pc < 0 {
+			break
+		}
+
+		if detectLoops {
+			word, bit := pc/64, uint64(1)<<(pc%64)
+			if visited[word]&bit != 0 {
+				break
+			}
+			visited[word] |= bit
+		}
+
+		switch c := &code[pc]; c.op {
+		case bcNop:
+			pc++
+		case bcAcc:
+			acc += c.arg
+			pc++
+		case bcJmp:
+			pc += c.arg
+		default:
+			vm.PC, vm.Accumulator = pc, acc
+			if err := bc.insns[pc].Execute(vm); err != nil {
+				vm.Err = fmt.Errorf("pc %d: %v", pc, err)
+				return false
+			}
+			pc, acc = vm.PC, vm.Accumulator
+		}
+	}
+
+	vm.PC, vm.Accumulator = pc, acc
+	return pc >= n
+}
+
+type Tracer struct {
+	Program *Program
+	Indices []int
+	Visited map[int]bool
+}
+
+func (t *Tracer) Reset() {
+	t.Indices = t.Indices[:0]
+	t.Visited = make(map[int]bool)
+}
+
+func (t *Tracer) Trace(vm *VM, insn *Instruction) bool {
+	if t.Visited[vm.PC] {
+		return true
+	}
+
+	t.Indices = append(t.Indices, vm.PC)
+	t.Visited[vm.PC] = true
+	return false
+}
+
+// Mark returns a snapshot of the tracer's state, to pass to Rewind
+func (t *Tracer) Mark() int {
+	return len(t.Indices)
+}
+
+// Rewind returns the tracer to the state at Mark, forgetting everything
+// visited since. The mark must be from the current run: since the tracer
+// only ever appends, rewinding just undoes the appends, which is much
+// cheaper than copying Visited.
+func (t *Tracer) Rewind(mark int) error {
+	if mark < 0 || mark > len(t.Indices) {
+		return fmt.Errorf("invalid tracer mark %d (%d traced)", mark, len(t.Indices))
+	}
+
+	for _, pc := range t.Indices[mark:] {
+		delete(t.Visited, pc)
+	}
+	t.Indices = t.Indices[:mark]
+
+	return nil
+}
+
+func (t *Tracer) Dump() {
+	for _, i := range t.Indices {
+		fmt.Println(t.Program.Instructions[i])
+	}
+}
+
+// TraceStep is one executed instruction in a recorded trace
+type TraceStep struct {
+	Step      int    `json:"step"`
+	PC        int    `json:"pc"`
+	Insn      string `json:"insn"`
+	AccBefore int    `json:"acc_before"`
+	AccAfter  int    `json:"acc_after"`
+}
+
+// TraceRecorder writes every step a VM executes to a JSON lines log. Its
+// Record method is called before each instruction, like a Breakpoint, and
+// finishes the previous step then, once the accumulator has been updated;
+// Close finishes the last one.
+type TraceRecorder struct {
+	enc     *json.Encoder
+	bw      *bufio.Writer
+	pending bool
+	step    TraceStep
+	err     error
+}
+
+func NewTraceRecorder(w io.Writer) *TraceRecorder {
+	bw := bufio.NewWriter(w)
+	return &TraceRecorder{
+		enc: json.NewEncoder(bw),
+		bw:  bw,
+	}
+}
+
+func (r *TraceRecorder) finish(vm *VM) {
+	if !r.pending || r.err != nil {
+		return
+	}
+
+	r.step.AccAfter = vm.Accumulator
+	r.err = r.enc.Encode(&r.step)
+	r.step.Step++
+	r.pending = false
+}
+
+// Record never stops execution, so it can be chained with other
+// breakpoints. It should only be called for instructions which are
+// actually about to be executed.
+func (r *TraceRecorder) Record(vm *VM, insn *Instruction) bool {
+	r.finish(vm)
+
+	r.step.PC = vm.PC
+	r.step.Insn = insn.Source()
+	r.step.AccBefore = vm.Accumulator
+	r.pending = true
+
+	return false
+}
+
+// Close writes the last step, given the VM after it was executed
+func (r *TraceRecorder) Close(vm *VM) error {
+	r.finish(vm)
+	if r.err != nil {
+		return r.err
+	}
+
+	return r.bw.Flush()
+}
+
+// TraceDivergence is where two traces first differ. A or B is nil if that
+// trace ended first.
+type TraceDivergence struct {
+	Step int
+	A, B *TraceStep
+
+	// Last is the final step the traces had in common, if any
+	Last *TraceStep
+}
+
+func readStep(dec *json.Decoder) (*TraceStep, error) {
+	var step TraceStep
+	if err := dec.Decode(&step); err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &step, nil
+}
+
+// DiffTraces reads two recorded traces in step, returning the first
+// divergence, or nil if they're the same
+func DiffTraces(a, b io.Reader) (*TraceDivergence, error) {
+	decA := json.NewDecoder(a)
+	decB := json.NewDecoder(b)
+
+	var last *TraceStep
+	for step := 0; ; step++ {
+		sa, err := readStep(decA)
+		if err != nil {
+			return nil, fmt.Errorf("first trace: step %d: %v", step, err)
+		}
+
+		sb, err := readStep(decB)
+		if err != nil {
+			return nil, fmt.Errorf("second trace: step %d: %v", step, err)
+		}
+
+		if sa == nil && sb == nil {
+			return nil, nil
+		}
+
+		if sa == nil || sb == nil || *sa != *sb {
+			return &TraceDivergence{Step: step, A: sa, B: sb, Last: last}, nil
+		}
+
+		last = sa
+	}
+}
+
+func formatStep(s *TraceStep) string {
+	if s == nil {
+		return "(end of trace)"
+	}
+
+	return fmt.Sprintf("%6d  pc %4d  %-12s acc %d -> %d", s.Step, s.PC, s.Insn, s.AccBefore, s.AccAfter)
+}
+
+// WriteText describes the divergence, marking each trace's step with < or >
+func (d *TraceDivergence) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "traces diverge at step %d\n", d.Step)
+	if d.Last != nil {
+		fmt.Fprintf(w, "  %s\n", formatStep(d.Last))
+	}
+	fmt.Fprintf(w, "< %s\n", formatStep(d.A))
+	fmt.Fprintf(w, "> %s\n", formatStep(d.B))
+}
+
+// Condition is a comparison of a VM register against a constant, like
+// "acc > 100", "pc == 7" or "x != 0"
+type Condition struct {
+	Register string
+	Op       string
+	Value    int
+}
+
+var conditionOps = map[string]func(a, b int) bool{
+	"==": func(a, b int) bool { return a == b },
+	"!=": func(a, b int) bool { return a != b },
+	"<":  func(a, b int) bool { return a < b },
+	"<=": func(a, b int) bool { return a <= b },
+	">":  func(a, b int) bool { return a > b },
+	">=": func(a, b int) bool { return a >= b },
+}
+
+// ParseCondition parses a condition. Any register name is accepted, and
+// registers which have never been written read as 0, so a misspelled
+// register is only caught by checking it against a program, as the
+// debugger does.
+func ParseCondition(fields []string) (*Condition, error) {
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("condition must be \"REGISTER OP VALUE\"")
+	}
+
+	c := &Condition{
+		Register: fields[0],
+		Op:       fields[1],
+	}
+
+	if !identRE.MatchString(c.Register) {
+		return nil, fmt.Errorf("invalid register: %s", c.Register)
+	}
+
+	if _, ok := conditionOps[c.Op]; !ok {
+		return nil, fmt.Errorf("unknown comparison: %s", c.Op)
+	}
+
+	v, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return nil, err
+	}
+	c.Value = v
+
+	return c, nil
+}
+
+func (c *Condition) Eval(vm *VM) bool {
+	reg := vm.PC
+	if c.Register != "pc" {
+		reg = vm.Reg(c.Register)
+	}
+
+	return conditionOps[c.Op](reg, c.Value)
+}
+
+func (c *Condition) String() string {
+	return fmt.Sprintf("%s %s %d", c.Register, c.Op, c.Value)
+}
+
+// DebugBreakpoint stops execution before the instruction at Addr (or any
+// address, if Addr is negative), if Cond is nil or true
+type DebugBreakpoint struct {
+	ID   int
+	Addr int
+	Cond *Condition
+}
+
+func (b *DebugBreakpoint) Hit(vm *VM) bool {
+	return (b.Addr < 0 || vm.PC == b.Addr) && (b.Cond == nil || b.Cond.Eval(vm))
+}
+
+func (b *DebugBreakpoint) String() string {
+	s := fmt.Sprintf("%d: ", b.ID)
+	if b.Addr >= 0 {
+		s += fmt.Sprintf("at %d", b.Addr)
+	} else {
+		s += "anywhere"
+	}
+	if b.Cond != nil {
+		s += " if " + b.Cond.String()
+	}
+
+	return s
+}
+
+// Debugger single-steps a VM through a Program, stopping at breakpoints
+// and watchpoints. It records the state before every step, so execution
+// can be stepped backwards too, up to MaxHistory steps.
+type Debugger struct {
+	VM      *VM
+	Program *Program
+
+	// MaxSteps limits how far Continue runs without stopping, so that
+	// looping programs give control back
+	MaxSteps int
+
+	// MaxHistory limits how many steps Back can undo. Once it's reached,
+	// each step drops the oldest snapshot. Zero means no limit, so a
+	// long-running session keeps a snapshot for every step it has taken.
+	MaxHistory int
+
+	Breakpoints []*DebugBreakpoint
+	nextID      int
+
+	// Watching stops execution whenever the accumulator changes, and
+	// WatchCond (if any) is true after the change
+	Watching  bool
+	WatchCond *Condition
+
+	history []VMSnapshot
+}
+
+func NewDebugger(vm *VM, program *Program) *Debugger {
+	return &Debugger{
+		VM:         vm,
+		Program:    program,
+		MaxSteps:   1000000,
+		MaxHistory: 100000,
+		nextID:     1,
+	}
+}
+
+func (d *Debugger) Terminated() bool {
+	return d.VM.PC < 0 || d.VM.PC >= len(d.Program.Instructions)
+}
+
+func (d *Debugger) AddBreakpoint(addr int, cond *Condition) *DebugBreakpoint {
+	bp := &DebugBreakpoint{ID: d.nextID, Addr: addr, Cond: cond}
+	d.nextID++
+	d.Breakpoints = append(d.Breakpoints, bp)
+
+	return bp
+}
+
+func (d *Debugger) DeleteBreakpoint(id int) error {
+	for i, bp := range d.Breakpoints {
+		if bp.ID == id {
+			d.Breakpoints = append(d.Breakpoints[:i], d.Breakpoints[i+1:]...)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no breakpoint %d", id)
+}
+
+// Step executes a single instruction. It returns the reason execution
+// should stop afterwards, if any.
+func (d *Debugger) Step() (string, error) {
+	if d.Terminated() {
+		return "", fmt.Errorf("program terminated")
+	}
+
+	d.record(d.VM.Snapshot())
+
+	before := d.VM.Accumulator
+	insn := d.Program.Instructions[d.VM.PC]
+	if err := insn.Execute(d.VM); err != nil {
+		d.history = d.history[:len(d.history)-1]
+		return "", err
+	}
+
+	if d.Terminated() {
+		return "terminated", nil
+	}
+
+	if d.Watching && d.VM.Accumulator != before && (d.WatchCond == nil || d.WatchCond.Eval(d.VM)) {
+		return fmt.Sprintf("watch: acc %d -> %d", before, d.VM.Accumulator), nil
+	}
+
+	for _, bp := range d.Breakpoints {
+		if bp.Hit(d.VM) {
+			return "breakpoint " + bp.String(), nil
+		}
+	}
+
+	return "", nil
+}
+
+// record adds a snapshot to the history, dropping the oldest beyond
+// MaxHistory. Slicing off the front leaves append to copy only the kept
+// snapshots when it next grows the array.
+func (d *Debugger) record(snapshot VMSnapshot) {
+	if d.MaxHistory > 0 && len(d.history) >= d.MaxHistory {
+		d.history = d.history[len(d.history)-d.MaxHistory+1:]
+	}
+
+	d.history = append(d.history, snapshot)
+}
+
+// Back undoes the last step
+func (d *Debugger) Back() error {
+	if len(d.history) == 0 {
+		return fmt.Errorf("no history")
+	}
+
+	last := d.history[len(d.history)-1]
+	d.history = d.history[:len(d.history)-1]
+
+	return d.VM.Restore(last)
+}
+
+// Continue steps until there's a reason to stop
+func (d *Debugger) Continue() (string, error) {
+	for i := 0; i < d.MaxSteps; i++ {
+		reason, err := d.Step()
+		if err != nil || reason != "" {
+			return reason, err
+		}
+	}
+
+	return fmt.Sprintf("stopped after %d steps", d.MaxSteps), nil
+}
+
+func (d *Debugger) Reset() {
+	d.VM.Reset()
+	d.history = d.history[:0]
+}
+
+func (d *Debugger) HistoryLen() int {
+	return len(d.history)
+}
+
+// List writes the instructions within n of the PC, marking the PC with
+// "=>" and breakpoint addresses with "*"
+func (d *Debugger) List(w io.Writer, n int) {
+	bps := make(map[int]bool)
+	for _, bp := range d.Breakpoints {
+		if bp.Addr >= 0 {
+			bps[bp.Addr] = true
+		}
+	}
+
+	for addr := d.VM.PC - n; addr <= d.VM.PC+n; addr++ {
+		if addr < 0 || addr >= len(d.Program.Instructions) {
+			continue
+		}
+
+		mark := "  "
+		if addr == d.VM.PC {
+			mark = "=>"
+		}
+
+		bp := " "
+		if bps[addr] {
+			bp = "*"
+		}
+
+		fmt.Fprintf(w, "%s%s %4d: %s\n", mark, bp, addr, d.Program.Instructions[addr].Source())
+	}
+}
+
+const debuggerHelp = `Commands:
+  step [N]               execute N instructions (default 1)
+  back [N]               undo N instructions (default 1)
+  continue               run until a breakpoint, watchpoint or termination
+  break [ADDR] [if COND] add a breakpoint, e.g. "break 12", "break if acc > 100"
+  delete ID              delete a breakpoint
+  watch [COND]           stop when the accumulator changes (and COND is true)
+  unwatch                remove the watchpoint
+  info                   list breakpoints and the watchpoint
+  regs                   show the registers
+  list [N]               show N instructions either side of the PC (default 5)
+  reset                  restart from the beginning, keeping breakpoints
+  quit                   exit
+An empty line repeats the previous command.
+`
+
+func parseCount(args []string, def int) (int, error) {
+	if len(args) == 0 {
+		return def, nil
+	}
+
+	return strconv.Atoi(args[0])
+}
+
+func (d *Debugger) printRegs(w io.Writer) {
+	fmt.Fprintf(w, "pc %d acc %d", d.VM.PC, d.VM.Accumulator)
+
+	names := make([]string, 0, len(d.VM.Registers))
+	for name := range d.VM.Registers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, " %s %d", name, d.VM.Registers[name])
+	}
+
+	fmt.Fprintf(w, " (%d steps)\n", len(d.history))
+}
+
+// parseCondition parses a condition on pc or a register the program uses
+func (d *Debugger) parseCondition(fields []string) (*Condition, error) {
+	cond, err := ParseCondition(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	if cond.Register != "pc" && !d.Program.Registers()[cond.Register] {
+		return nil, fmt.Errorf("program doesn't use register: %s", cond.Register)
+	}
+
+	return cond, nil
+}
+
+// Command runs a single debugger command. It returns true if the
+// debugger should exit.
+func (d *Debugger) Command(w io.Writer, fields []string) (bool, error) {
+	if len(fields) == 0 {
+		return false, nil
+	}
+
+	cmd, args := fields[0], fields[1:]
+	switch cmd {
+	case "step", "s":
+		n, err := parseCount(args, 1)
+		if err != nil {
+			return false, err
+		}
+
+		for i := 0; i < n; i++ {
+			reason, err := d.Step()
+			if err != nil {
+				return false, err
+			}
+			if reason != "" {
+				fmt.Fprintln(w, reason)
+				break
+			}
+		}
+		d.List(w, 0)
+	case "back", "b":
+		n, err := parseCount(args, 1)
+		if err != nil {
+			return false, err
+		}
+
+		for i := 0; i < n; i++ {
+			if err := d.Back(); err != nil {
+				return false, err
+			}
+		}
+		d.List(w, 0)
+	case "continue", "c":
+		reason, err := d.Continue()
+		if err != nil {
+			return false, err
+		}
+		fmt.Fprintln(w, reason)
+		d.List(w, 0)
+	case "break":
+		addr := -1
+		if len(args) > 0 && args[0] != "if" {
+			a, err := strconv.Atoi(args[0])
+			if err != nil {
+				return false, err
+			}
+			if a < 0 || a >= len(d.Program.Instructions) {
+				return false, fmt.Errorf("address out of range: %d", a)
+			}
+			addr = a
+			args = args[1:]
+		}
+
+		var cond *Condition
+		if len(args) > 0 {
+			if args[0] != "if" {
+				return false, fmt.Errorf("expected \"if\": %s", args[0])
+			}
+
+			var err error
+			cond, err = d.parseCondition(args[1:])
+			if err != nil {
+				return false, err
+			}
+		}
+
+		if addr < 0 && cond == nil {
+			return false, fmt.Errorf("breakpoint needs an address or a condition")
+		}
+
+		fmt.Fprintln(w, "breakpoint", d.AddBreakpoint(addr, cond))
+	case "delete":
+		id, err := parseCount(args, -1)
+		if err != nil {
+			return false, err
+		}
+
+		return false, d.DeleteBreakpoint(id)
+	case "watch":
+		var cond *Condition
+		if len(args) > 0 {
+			var err error
+			cond, err = d.parseCondition(args)
+			if err != nil {
+				return false, err
+			}
+		}
+
+		d.Watching = true
+		d.WatchCond = cond
+	case "unwatch":
+		d.Watching = false
+		d.WatchCond = nil
+	case "info":
+		for _, bp := range d.Breakpoints {
+			fmt.Fprintln(w, "breakpoint", bp)
+		}
+		if d.Watching {
+			if d.WatchCond != nil {
+				fmt.Fprintln(w, "watching acc if", d.WatchCond)
+			} else {
+				fmt.Fprintln(w, "watching acc")
+			}
+		}
+	case "regs", "r":
+		d.printRegs(w)
+	case "list", "l":
+		n, err := parseCount(args, 5)
+		if err != nil {
+			return false, err
+		}
+		d.List(w, n)
+	case "reset":
+		d.Reset()
+		d.List(w, 0)
+	case "quit", "q":
+		return true, nil
+	case "help", "h":
+		fmt.Fprint(w, debuggerHelp)
+	default:
+		return false, fmt.Errorf("unknown command: %s (try \"help\")", cmd)
+	}
+
+	return false, nil
+}
+
+// Run reads commands from r until "quit" or EOF, writing output to w
+func (d *Debugger) Run(r io.Reader, w io.Writer) error {
+	var last []string
+
+	scanner := bufio.NewScanner(r)
+	for {
+		fmt.Fprint(w, "(dbg) ")
+		if !scanner.Scan() {
+			fmt.Fprintln(w)
+			break
+		}
+
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			fields = last
+		}
+		last = fields
+
+		quit, err := d.Command(w, fields)
+		if err != nil {
+			fmt.Fprintln(w, "error:", err)
+		}
+
+		if quit {
+			return nil
+		}
+	}
+
+	return scanner.Err()
 }
 
-func (vm *VM) Reset() {
-	vm.PC = 0
-	vm.Accumulator = 0
+// CFG is the control-flow graph of a Program using only the original
+// acc, jmp and nop instructions. Every instruction has exactly one
+// successor, so it's just an array.
+type CFG struct {
+	// Succ is the address executed after each instruction. Any address
+	// past the end of the program means normal termination, and a
+	// negative one means a crash.
+	Succ []int
+
+	// Terminates is true for each instruction from which execution
+	// reaches the end of the program
+	Terminates []bool
 }
 
-func (vm *VM) Execute(program *Program) bool {
-	normalTermination := true
-	for vm.PC < len(program.Instructions) {
-		insn := program.Instructions[vm.PC]
-		if vm.Breakpoint != nil && vm.Breakpoint(vm, &insn) {
-			normalTermination = false
-			break
+// checkRepairable returns an error if program uses anything other than the
+// original instructions, which have a single successor and can't fail
+func checkRepairable(program *Program) error {
+	for addr, insn := range program.Instructions {
+		switch insn.Opcode {
+		case "acc", "jmp", "nop":
+		default:
+			return fmt.Errorf("%d: can't analyse %s instructions", addr, insn.Opcode)
 		}
-		insn.Execute(vm)
 	}
 
-	return normalTermination
+	return nil
 }
 
-type Instruction struct {
-	Opcode string
-	Arg    int
+func successor(addr int, insn Instruction) int {
+	if insn.Opcode == "jmp" {
+		return addr + insn.Arg
+	}
+	return addr + 1
 }
 
-func (insn Instruction) Execute(on *VM) {
+// flipped returns insn with jmp and nop swapped
+func flipped(insn Instruction) Instruction {
 	switch insn.Opcode {
-	case "acc":
-		on.Accumulator += insn.Arg
-		on.PC += 1
 	case "jmp":
-		on.PC += insn.Arg
+		insn.Opcode = "nop"
 	case "nop":
-		on.PC += 1
-	default:
-		panic(insn.Opcode)
+		insn.Opcode = "jmp"
 	}
+
+	return insn
 }
 
-func (insn Instruction) String() string {
-	return fmt.Sprintf("%s %d", insn.Opcode, insn.Arg)
+// BuildCFG computes the successor of every instruction, and which
+// instructions lead to termination, in O(n). Instructions other than jmp
+// are assumed to continue to the next one, so the program should pass
+// checkRepairable.
+func BuildCFG(program *Program) *CFG {
+	n := len(program.Instructions)
+	cfg := &CFG{
+		Succ:       make([]int, n),
+		Terminates: make([]bool, n),
+	}
+
+	// Reverse edges, from each address to its predecessors. Everything
+	// past the end is collapsed onto address n.
+	preds := make([][]int, n+1)
+	for addr, insn := range program.Instructions {
+		succ := successor(addr, insn)
+		cfg.Succ[addr] = succ
+
+		if succ >= n {
+			preds[n] = append(preds[n], addr)
+		} else if succ >= 0 {
+			preds[succ] = append(preds[succ], addr)
+		}
+	}
+
+	// Everything which can reach the end, by walking backwards from it
+	queue := []int{n}
+	for len(queue) > 0 {
+		addr := queue[0]
+		queue = queue[1:]
+
+		for _, p := range preds[addr] {
+			if !cfg.Terminates[p] {
+				cfg.Terminates[p] = true
+				queue = append(queue, p)
+			}
+		}
+	}
+
+	return cfg
 }
 
-func ParseInstruction(s string) (Instruction, error) {
-	parts := strings.Split(s, " ")
-	if len(parts) != 2 {
-		return Instruction{}, fmt.Errorf("couldn't parse instruction parts: %s", s)
+func (cfg *CFG) terminatesFrom(addr int) bool {
+	return addr >= len(cfg.Succ) || (addr >= 0 && cfg.Terminates[addr])
+}
+
+// terminatesWithFlip follows the program from address 0 with the
+// instruction at fix flipped, reporting whether it terminates normally
+func terminatesWithFlip(program *Program, fix int) bool {
+	n := len(program.Instructions)
+	visited := make([]bool, n)
+
+	for addr := 0; addr < n; {
+		if addr < 0 || visited[addr] {
+			return false
+		}
+		visited[addr] = true
+
+		insn := program.Instructions[addr]
+		if addr == fix {
+			insn = flipped(insn)
+		}
+		addr = successor(addr, insn)
 	}
 
-	arg, err := strconv.Atoi(parts[1])
-	if err != nil {
-		return Instruction{}, err
+	return true
+}
+
+// FindRepair finds an instruction on the executed path which, when
+// flipped between jmp and nop, makes the program terminate. Flipping an
+// instruction which isn't executed can't change anything, and once the
+// flip is made, execution continues from the new successor, so the fix
+// must send the path into CFG.Terminates.
+//
+// The CFG is computed without the flip, but when the original program
+// loops, that doesn't matter: no instruction on its path is in
+// CFG.Terminates, so the route from the new successor to the end can't
+// pass back through the flipped instruction, and the path up to it is
+// unchanged. The search is then O(n) overall. Only when the program
+// already terminates can a flip make it loop, so in that case each
+// candidate is checked by following the flipped program, in O(n) each.
+func FindRepair(program *Program) (int, error) {
+	if err := checkRepairable(program); err != nil {
+		return 0, err
+	}
+
+	n := len(program.Instructions)
+	cfg := BuildCFG(program)
+	recheck := cfg.terminatesFrom(0)
+
+	visited := make([]bool, n)
+	for addr := 0; addr >= 0 && addr < n && !visited[addr]; addr = cfg.Succ[addr] {
+		visited[addr] = true
+
+		insn := program.Instructions[addr]
+		if insn.Opcode != "jmp" && insn.Opcode != "nop" {
+			continue
+		}
+
+		if cfg.terminatesFrom(successor(addr, flipped(insn))) && (!recheck || terminatesWithFlip(program, addr)) {
+			return addr, nil
+		}
 	}
 
-	return Instruction{
-		Opcode: parts[0],
-		Arg:    arg,
-	}, nil
+	return 0, fmt.Errorf("couldn't find a terminating case")
 }
 
-type Program struct {
-	Instructions []Instruction
+// BruteForceRepair tries flipping every jmp and nop in turn, running the
+// whole program each time. It's O(n^2), but obviously correct.
+func BruteForceRepair(program *Program) (int, error) {
+	vm := &VM{}
+	tracer := &Tracer{
+		Program: program,
+		Visited: make(map[int]bool),
+	}
+	vm.Breakpoint = func(vm *VM, insn *Instruction) bool { return tracer.Trace(vm, insn) }
+
+	for i, insn := range program.Instructions {
+		if insn.Opcode != "jmp" && insn.Opcode != "nop" {
+			continue
+		}
+
+		program.Instructions[i] = flipped(insn)
+
+		vm.Reset()
+		tracer.Reset()
+		result := vm.Execute(program)
+
+		// Revert
+		program.Instructions[i] = insn
+
+		if result {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("couldn't find a terminating case")
 }
 
-type Tracer struct {
-	Program *Program
-	Indices []int
-	Visited map[int]bool
+// WhatIfRepair runs the program once, and before each jmp or nop it
+// reaches, forks: it flips the instruction, continues from that point, and
+// if that doesn't terminate, restores the VM and tracer and carries on
+// with the original. Unlike BruteForceRepair, the shared prefix of each
+// patched run is only executed once. It returns the address of the fix and
+// the accumulator at termination.
+func WhatIfRepair(program *Program) (int, int, error) {
+	n := len(program.Instructions)
+
+	vm := &VM{}
+	tracer := &Tracer{
+		Program: program,
+		Visited: make(map[int]bool),
+	}
+	vm.Breakpoint = func(vm *VM, insn *Instruction) bool { return tracer.Trace(vm, insn) }
+
+	for vm.PC >= 0 && vm.PC < n && !tracer.Visited[vm.PC] {
+		addr := vm.PC
+		insn := program.Instructions[addr]
+
+		if insn.Opcode == "jmp" || insn.Opcode == "nop" {
+			snapshot := vm.SnapshotWith(tracer)
+
+			program.Instructions[addr] = flipped(insn)
+			result := vm.Execute(program)
+			program.Instructions[addr] = insn
+
+			if result {
+				return addr, vm.Accumulator, nil
+			}
+
+			if err := vm.Restore(snapshot); err != nil {
+				return 0, 0, err
+			}
+		}
+
+		// Carry on with the original instruction
+		tracer.Trace(vm, &insn)
+		if err := insn.Execute(vm); err != nil {
+			return 0, 0, fmt.Errorf("pc %d: %v", addr, err)
+		}
+	}
+
+	return 0, 0, fmt.Errorf("couldn't find a terminating case")
 }
 
-func (t *Tracer) Reset() {
-	t.Indices = t.Indices[:0]
-	t.Visited = make(map[int]bool)
+func runWhatIf(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: %s whatif INPUT", os.Args[0])
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	program, err := Assemble(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", args[0], err)
+	}
+
+	fix, acc, err := WhatIfRepair(program)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Accumulator at normal termination (patched %s at %d): %d\n", program.Instructions[fix].Opcode, fix, acc)
+
+	return nil
 }
 
-func (t *Tracer) Trace(vm *VM, insn *Instruction) bool {
-	if t.Visited[vm.PC] {
-		return true
+func runDebug(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: %s debug SOURCE", os.Args[0])
 	}
 
-	t.Indices = append(t.Indices, vm.PC)
-	t.Visited[vm.PC] = true
-	return false
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	program, err := Assemble(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", args[0], err)
+	}
+
+	d := NewDebugger(&VM{}, program)
+	d.List(os.Stdout, 0)
+
+	return d.Run(os.Stdin, os.Stdout)
 }
 
-func (t *Tracer) Dump() {
-	for _, i := range t.Indices {
-		fmt.Println(t.Program.Instructions[i])
+func runAsm(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: %s asm SOURCE", os.Args[0])
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	program, err := Assemble(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", args[0], err)
+	}
+
+	for _, insn := range program.Instructions {
+		fmt.Println(insn.Source())
 	}
+
+	return nil
 }
 
-func run() error {
-	if len(os.Args) != 2 {
-		return fmt.Errorf("Usage: %s INPUT", os.Args[0])
+func runDisasm(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: %s disasm INPUT", os.Args[0])
 	}
 
-	f, err := os.Open(os.Args[1])
+	f, err := os.Open(args[0])
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	vm := &VM{}
-	program := &Program{
-		Instructions: make([]Instruction, 0, 100),
+	program, err := Assemble(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", args[0], err)
+	}
+
+	return Disassemble(os.Stdout, program)
+}
+
+// runTrace writes a trace of the program to stdout, stopping before any
+// instruction runs twice. Tracing with the instruction at FLIP swapped
+// between jmp and nop gives a trace to compare against.
+func runTrace(args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return fmt.Errorf("Usage: %s trace SOURCE [FLIP]", os.Args[0])
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	program, err := Assemble(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", args[0], err)
+	}
+
+	if len(args) == 2 {
+		fix, err := strconv.Atoi(args[1])
+		if err != nil {
+			return err
+		}
+
+		if fix < 0 || fix >= len(program.Instructions) {
+			return fmt.Errorf("address out of range: %d", fix)
+		}
+		program.Instructions[fix] = flipped(program.Instructions[fix])
 	}
+
+	vm := &VM{}
 	tracer := &Tracer{
 		Program: program,
-		Indices: make([]int, 0),
 		Visited: make(map[int]bool),
 	}
-	vm.Breakpoint = func(vm *VM, insn *Instruction) bool { return tracer.Trace(vm, insn) }
+	recorder := NewTraceRecorder(os.Stdout)
+	vm.Breakpoint = func(vm *VM, insn *Instruction) bool {
+		if tracer.Trace(vm, insn) {
+			return true
+		}
+		return recorder.Record(vm, insn)
+	}
 
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := scanner.Text()
+	vm.Execute(program)
+	if err := recorder.Close(vm); err != nil {
+		return err
+	}
 
-		i, err := ParseInstruction(line)
-		if err != nil {
-			return err
+	return vm.Err
+}
+
+func runTraceDiff(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("Usage: %s tracediff TRACE1 TRACE2", os.Args[0])
+	}
+
+	a, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	b, err := os.Open(args[1])
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	d, err := DiffTraces(a, b)
+	if err != nil {
+		return err
+	}
+
+	if d == nil {
+		fmt.Println("traces are identical")
+		return nil
+	}
+
+	d.WriteText(os.Stdout)
+	return nil
+}
+
+// runProgram runs a program with stdin, one number per line, as its input,
+// printing its output
+func runProgram(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: %s run SOURCE", os.Args[0])
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	program, err := Assemble(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", args[0], err)
+	}
+
+	input := make(chan int)
+	output := make(chan int)
+	vm := &VM{Input: input, Output: output}
+
+	// Input is read as the program asks for it, so interactive use works
+	go func() {
+		defer close(input)
+
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+
+			v, err := strconv.Atoi(line)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "ignoring bad input:", line)
+				continue
+			}
+			input <- v
 		}
+	}()
+
+	done := make(chan bool, 1)
+	go func() {
+		defer close(output)
+		done <- vm.Execute(program)
+	}()
 
-		program.Instructions = append(program.Instructions, i)
+	for v := range output {
+		fmt.Println(v)
 	}
 
-	if err := scanner.Err(); err != nil {
+	if !<-done {
+		if vm.Err != nil {
+			return vm.Err
+		}
+		return fmt.Errorf("abnormal termination at pc %d", vm.PC)
+	}
+
+	return nil
+}
+
+func run() error {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "asm":
+			return runAsm(os.Args[2:])
+		case "disasm":
+			return runDisasm(os.Args[2:])
+		case "debug":
+			return runDebug(os.Args[2:])
+		case "run":
+			return runProgram(os.Args[2:])
+		case "trace":
+			return runTrace(os.Args[2:])
+		case "tracediff":
+			return runTraceDiff(os.Args[2:])
+		case "whatif":
+			return runWhatIf(os.Args[2:])
+		}
+	}
+
+	if len(os.Args) != 2 {
+		return fmt.Errorf("Usage: %s INPUT\n"+
+			"       %s asm SOURCE\n"+
+			"       %s disasm INPUT\n"+
+			"       %s debug SOURCE\n"+
+			"       %s run SOURCE\n"+
+			"       %s trace SOURCE [FLIP]\n"+
+			"       %s tracediff TRACE1 TRACE2\n"+
+			"       %s whatif INPUT",
+			os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+	}
+
+	f, err := os.Open(os.Args[1])
+	if err != nil {
 		return err
 	}
+	defer f.Close()
+
+	// The puzzle input is valid assembler source
+	program, err := Assemble(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", os.Args[1], err)
+	}
+
+	vm := &VM{}
+	tracer := &Tracer{
+		Program: program,
+		Indices: make([]int, 0),
+		Visited: make(map[int]bool),
+	}
+	vm.Breakpoint = func(vm *VM, insn *Instruction) bool { return tracer.Trace(vm, insn) }
 
 	fmt.Println("Parsed", len(program.Instructions))
 
@@ -159,34 +1896,23 @@ func run() error {
 		return fmt.Errorf("last instruction not a jmp?")
 	}
 
-	// Patch all jumps to nops, and vice versa
-	mapping := map[string]string{
-		"nop": "jmp",
-		"jmp": "nop",
+	fix, err := FindRepair(program)
+	if err != nil {
+		return err
 	}
-	for i := 0; i < len(program.Instructions); i++ {
-		insn := program.Instructions[i]
-		from := insn.Opcode
-		if to, ok := mapping[insn.Opcode]; ok {
-			insn.Opcode = to
-			program.Instructions[i] = insn
-
-			vm.Reset()
-			tracer.Reset()
-			result = vm.Execute(program)
 
-			if result {
-				fmt.Printf("Accumulator at normal termination (patched %s at %d): %d\n", from, i, vm.Accumulator)
-				return nil
-			}
+	from := program.Instructions[fix].Opcode
+	program.Instructions[fix] = flipped(program.Instructions[fix])
 
-			// Still looped, so revert
-			insn.Opcode = from
-			program.Instructions[i] = insn
-		}
+	vm.Reset()
+	tracer.Reset()
+	if !vm.Execute(program) {
+		return fmt.Errorf("patched program didn't terminate")
 	}
 
-	return fmt.Errorf("couldn't find a terminating case")
+	fmt.Printf("Accumulator at normal termination (patched %s at %d): %d\n", from, fix, vm.Accumulator)
+
+	return nil
 }
 
 func main() {
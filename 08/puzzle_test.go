@@ -1,6 +1,9 @@
 package main
 
 import (
+	"fmt"
+	"math/rand"
+	"strings"
 	"testing"
 )
 
@@ -188,3 +191,934 @@ func TestParse(t *testing.T) {
 	}
 
 }
+
+func TestAssemble(t *testing.T) {
+	src := `; count down from 3
+	acc +3
+loop:	acc -1     # decrement
+	nop +0
+	jmp check
+check:
+	jmp loop
+	nop end
+end:
+`
+	program, err := Assemble(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Instruction{
+		{Opcode: "acc", Arg: 3},
+		{Opcode: "acc", Arg: -1},
+		{Opcode: "nop", Arg: 0},
+		{Opcode: "jmp", Arg: 1},
+		{Opcode: "jmp", Arg: -3},
+		{Opcode: "nop", Arg: 1},
+	}
+
+	if len(program.Instructions) != len(expected) {
+		t.Fatalf("expected %v got %v", expected, program.Instructions)
+	}
+
+	for i := range expected {
+		if program.Instructions[i] != expected[i] {
+			t.Errorf("%d: expected %v got %v", i, expected[i], program.Instructions[i])
+		}
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	tests := []string{
+		"jmp nowhere",
+		"a:\na: nop +0",
+		"foo +1",
+		"acc",
+		"acc +1 +2",
+		"x: acc x",
+		"1abc: nop +0",
+		"acc one+",
+	}
+
+	for _, src := range tests {
+		if _, err := Assemble(strings.NewReader(src)); err == nil {
+			t.Errorf("%q: expected error", src)
+		}
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	program := &Program{
+		Instructions: []Instruction{
+			{Opcode: "nop", Arg: 0},
+			{Opcode: "acc", Arg: 1},
+			{Opcode: "jmp", Arg: 4},
+			{Opcode: "acc", Arg: 3},
+			{Opcode: "jmp", Arg: -3},
+			{Opcode: "acc", Arg: -99},
+			{Opcode: "acc", Arg: 1},
+			{Opcode: "jmp", Arg: -4},
+			{Opcode: "jmp", Arg: 100},
+			{Opcode: "nop", Arg: 1},
+		},
+	}
+
+	var sb strings.Builder
+	if err := Disassemble(&sb, program); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `	nop +0
+L1:
+	acc +1
+	jmp L6
+L3:
+	acc +3
+	jmp L1
+	acc -99
+L6:
+	acc +1
+	jmp L3
+	jmp +100
+	nop end
+end:
+`
+	if sb.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, sb.String())
+	}
+
+	reassembled, err := Assemble(strings.NewReader(sb.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, insn := range program.Instructions {
+		if reassembled.Instructions[i] != insn {
+			t.Errorf("%d: expected %v got %v", i, insn, reassembled.Instructions[i])
+		}
+	}
+}
+
+func debugProgram(t *testing.T) *Debugger {
+	src := `
+	acc +1
+loop:
+	acc +10
+	nop +0
+	jmp loop
+`
+	program, err := Assemble(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewDebugger(&VM{}, program)
+}
+
+func TestDebuggerStepBack(t *testing.T) {
+	d := debugProgram(t)
+
+	for i := 0; i < 5; i++ {
+		if _, err := d.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if d.VM.PC != 2 || d.VM.Accumulator != 21 {
+		t.Errorf("%#v", *d.VM)
+	}
+
+	for i := 0; i < 4; i++ {
+		if err := d.Back(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if d.VM.PC != 1 || d.VM.Accumulator != 1 {
+		t.Errorf("%#v", *d.VM)
+	}
+
+	d.Back()
+	if err := d.Back(); err == nil {
+		t.Errorf("expected error stepping back past the start")
+	}
+}
+
+func TestDebuggerBreakpoints(t *testing.T) {
+	d := debugProgram(t)
+
+	d.AddBreakpoint(3, nil)
+	if _, err := d.Continue(); err != nil {
+		t.Fatal(err)
+	}
+	if d.VM.PC != 3 || d.VM.Accumulator != 11 {
+		t.Errorf("%#v", *d.VM)
+	}
+
+	// Continuing from a breakpoint must make progress
+	if _, err := d.Continue(); err != nil {
+		t.Fatal(err)
+	}
+	if d.VM.PC != 3 || d.VM.Accumulator != 21 {
+		t.Errorf("%#v", *d.VM)
+	}
+
+	d.DeleteBreakpoint(1)
+	cond, err := ParseCondition([]string{"acc", ">=", "50"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.AddBreakpoint(-1, cond)
+
+	if _, err := d.Continue(); err != nil {
+		t.Fatal(err)
+	}
+	if d.VM.PC != 2 || d.VM.Accumulator != 51 {
+		t.Errorf("%#v", *d.VM)
+	}
+}
+
+func TestDebuggerWatch(t *testing.T) {
+	d := debugProgram(t)
+	d.Watching = true
+
+	reason, err := d.Continue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(reason, "watch") || d.VM.Accumulator != 1 {
+		t.Errorf("%s: %#v", reason, *d.VM)
+	}
+
+	d.WatchCond = &Condition{"acc", ">", 30}
+	if _, err := d.Continue(); err != nil {
+		t.Fatal(err)
+	}
+	if d.VM.Accumulator != 31 {
+		t.Errorf("%#v", *d.VM)
+	}
+}
+
+func TestDebuggerMaxSteps(t *testing.T) {
+	d := debugProgram(t)
+	d.MaxSteps = 100
+
+	reason, err := d.Continue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.HistoryLen() != 100 {
+		t.Errorf("%s: expected 100 steps, got %d", reason, d.HistoryLen())
+	}
+}
+
+func TestDebuggerMaxHistory(t *testing.T) {
+	d := debugProgram(t)
+	d.MaxSteps = 10
+	d.MaxHistory = 3
+
+	if _, err := d.Continue(); err != nil {
+		t.Fatal(err)
+	}
+	if d.HistoryLen() != 3 {
+		t.Fatalf("expected 3 steps of history, got %d", d.HistoryLen())
+	}
+
+	want := *d.VM
+	for i := 0; i < 3; i++ {
+		if _, err := d.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if err := d.Back(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d.VM.PC != want.PC || d.VM.Accumulator != want.Accumulator {
+		t.Errorf("expected pc %d acc %d, got pc %d acc %d", want.PC, want.Accumulator, d.VM.PC, d.VM.Accumulator)
+	}
+	if err := d.Back(); err == nil {
+		t.Error("expected error stepping back past the oldest snapshot")
+	}
+}
+
+func TestDebuggerREPL(t *testing.T) {
+	d := debugProgram(t)
+
+	var out strings.Builder
+	cmds := "break 2 if acc > 15\nc\n\nregs\nback\nbreak\nwatch acc foo 1\nquit\n"
+	if err := d.Run(strings.NewReader(cmds), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"breakpoint 1: at 2 if acc > 15",
+		"pc 2 acc 31 (8 steps)",
+		"error: breakpoint needs an address or a condition",
+		"error: unknown comparison: foo",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected output to contain %q:\n%s", expected, out.String())
+		}
+	}
+
+	if d.VM.PC != 1 || d.VM.Accumulator != 21 {
+		t.Errorf("%#v", *d.VM)
+	}
+}
+
+var exampleProgram = `nop +0
+acc +1
+jmp +4
+acc +3
+jmp -3
+acc -99
+acc +1
+jmp -4
+acc +6
+`
+
+func TestFindRepair(t *testing.T) {
+	program, err := Assemble(strings.NewReader(exampleProgram))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := BuildCFG(program)
+	for addr, expected := range []bool{false, false, false, false, false, false, false, false, true} {
+		if cfg.Terminates[addr] != expected {
+			t.Errorf("%d: expected terminates %v", addr, expected)
+		}
+	}
+
+	fix, err := FindRepair(program)
+	if err != nil {
+		t.Fatal(err)
+	} else if fix != 7 {
+		t.Errorf("expected fix at 7 got %d", fix)
+	}
+
+	oracle, err := BruteForceRepair(program)
+	if err != nil {
+		t.Fatal(err)
+	} else if oracle != fix {
+		t.Errorf("brute force found %d, expected %d", oracle, fix)
+	}
+}
+
+func randomProgram(rng *rand.Rand, n int) *Program {
+	opcodes := []string{"acc", "jmp", "nop"}
+
+	program := &Program{}
+	for i := 0; i < n; i++ {
+		program.Instructions = append(program.Instructions, Instruction{
+			Opcode: opcodes[rng.Intn(len(opcodes))],
+			Arg:    rng.Intn(11) - 5,
+		})
+	}
+
+	return program
+}
+
+func TestFindRepairOracle(t *testing.T) {
+	rng := rand.New(rand.NewSource(8))
+
+	found := 0
+	for i := 0; i < 2000; i++ {
+		program := randomProgram(rng, 5+rng.Intn(30))
+
+		// Only programs which loop need repairing
+		if terminatesWithFlip(program, -1) {
+			continue
+		}
+
+		fix, err := FindRepair(program)
+		_, oracleErr := BruteForceRepair(program)
+
+		if (err == nil) != (oracleErr == nil) {
+			t.Fatalf("%v: FindRepair: %v, brute force: %v", program.Instructions, err, oracleErr)
+		}
+
+		if err != nil {
+			continue
+		}
+		found++
+
+		// There may be more than one fix, so check this one works
+		patched := &Program{Instructions: append([]Instruction{}, program.Instructions...)}
+		patched.Instructions[fix] = flipped(patched.Instructions[fix])
+
+		tracer := &Tracer{Program: patched, Visited: make(map[int]bool)}
+		vm := &VM{Breakpoint: tracer.Trace}
+		if !vm.Execute(patched) {
+			t.Errorf("%v: flipping %d doesn't terminate", program.Instructions, fix)
+		}
+	}
+
+	if found == 0 {
+		t.Errorf("no repairable programs generated")
+	}
+}
+
+func TestRegisters(t *testing.T) {
+	// Multiplies the two inputs by repeated addition
+	src := `	in x
+	in y
+	set n 0
+loop:	jz y done
+	add n x
+	add y -1
+	jmp loop
+done:	out n
+	add acc 5
+	acc +1
+	out acc
+`
+	program, err := Assemble(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := make(chan int, 2)
+	output := make(chan int, 2)
+	input <- 6
+	input <- 7
+
+	vm := &VM{Input: input, Output: output}
+	if !vm.Execute(program) {
+		t.Fatalf("abnormal termination: %v", vm.Err)
+	}
+
+	if v := <-output; v != 42 {
+		t.Errorf("expected 42 got %d", v)
+	}
+	if v := <-output; v != 6 {
+		t.Errorf("expected 6 got %d", v)
+	}
+	if vm.Reg("x") != 6 || vm.Reg("y") != 0 || vm.Reg("missing") != 0 {
+		t.Errorf("registers: %v", vm.Registers)
+	}
+}
+
+func TestInstructionErrors(t *testing.T) {
+	tests := []Instruction{
+		{Opcode: "in", Reg: "x"},
+		{Opcode: "out", Arg: 1},
+		{Opcode: "bogus", Arg: 1},
+	}
+
+	for _, insn := range tests {
+		vm := &VM{}
+		program := &Program{Instructions: []Instruction{insn}}
+		if vm.Execute(program) || vm.Err == nil {
+			t.Errorf("%v: expected error", insn)
+		}
+	}
+
+	// Closed input
+	input := make(chan int)
+	close(input)
+	vm := &VM{Input: input}
+	if err := tests[0].Execute(vm); err == nil {
+		t.Error("expected error at end of input")
+	}
+}
+
+func TestParseOperands(t *testing.T) {
+	tests := []struct {
+		s   string
+		str string
+	}{
+		{"set x 3", "set x +3"},
+		{"add acc y", "add acc y"},
+		{"jnz x -2", "jnz x -2"},
+		{"jz 0 +4", "jz +0 +4"},
+		{"acc +3", "acc 3"},
+	}
+
+	for _, test := range tests {
+		insn, err := ParseInstruction(test.s)
+		if err != nil {
+			t.Errorf("%q: %v", test.s, err)
+			continue
+		}
+
+		if insn.String() != test.str {
+			t.Errorf("%q: expected %q got %q", test.s, test.str, insn.String())
+		}
+	}
+
+	bad := []string{
+		"set 1 2",
+		"set x",
+		"mul x y z",
+		"set pc 1",
+		"jmp x",
+		"acc x",
+		"in 3",
+	}
+
+	for _, s := range bad {
+		if _, err := ParseInstruction(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+func TestRegisterOpcode(t *testing.T) {
+	RegisterOpcode(&OpcodeDef{
+		Name:     "test_dbl",
+		Operands: []OperandKind{OperandReg},
+		Exec: func(vm *VM, insn *Instruction) error {
+			vm.SetReg(insn.Reg, vm.Reg(insn.Reg)*2)
+			vm.PC += 1
+			return nil
+		},
+	})
+	defer delete(opcodes, "test_dbl")
+
+	program, err := Assemble(strings.NewReader("acc +3\ntest_dbl acc\ntest_dbl acc\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := &VM{}
+	if !vm.Execute(program) || vm.Accumulator != 12 {
+		t.Errorf("expected 12 got %d", vm.Accumulator)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic for duplicate opcode")
+		}
+	}()
+	RegisterOpcode(&OpcodeDef{Name: "acc"})
+}
+
+func TestDisassembleRegisters(t *testing.T) {
+	src := "set x 3\nloop: add x -1\njnz x loop\nout x\n"
+	program, err := Assemble(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sb strings.Builder
+	if err := Disassemble(&sb, program); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `	set x +3
+L1:
+	add x -1
+	jnz x L1
+	out x
+`
+	if sb.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, sb.String())
+	}
+}
+
+func TestDebuggerRegisters(t *testing.T) {
+	program, err := Assemble(strings.NewReader("set x 1\nadd x 1\nadd x 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDebugger(&VM{}, program)
+	cond, err := ParseCondition([]string{"x", ">=", "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.AddBreakpoint(-1, cond)
+
+	if reason, err := d.Continue(); err != nil || !strings.HasPrefix(reason, "breakpoint") || d.VM.PC != 2 {
+		t.Errorf("reason %q err %v pc %d", reason, err, d.VM.PC)
+	}
+
+	if err := d.Back(); err != nil || d.VM.Reg("x") != 1 {
+		t.Errorf("after back: x %d err %v", d.VM.Reg("x"), err)
+	}
+	// The debugger only accepts registers the program uses
+	var sb strings.Builder
+	for _, cmd := range []string{"break if acc > 1", "break if pc == 1", "watch x != 0"} {
+		if _, err := d.Command(&sb, strings.Fields(cmd)); err != nil {
+			t.Errorf("%q: %v", cmd, err)
+		}
+	}
+	for _, cmd := range []string{"break if ac > 1", "watch y == 0"} {
+		if _, err := d.Command(&sb, strings.Fields(cmd)); err == nil {
+			t.Errorf("%q: expected error", cmd)
+		}
+	}
+}
+
+func TestFindRepairRegisters(t *testing.T) {
+	program, err := Assemble(strings.NewReader("set x 1\njmp -1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := FindRepair(program); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestBytecode(t *testing.T) {
+	rng := rand.New(rand.NewSource(8))
+
+	for i := 0; i < 200; i++ {
+		program := randomProgram(rng, 1+rng.Intn(100))
+
+		vm := &VM{}
+		tracer := &Tracer{Program: program, Visited: make(map[int]bool)}
+		vm.Breakpoint = tracer.Trace
+		expected := vm.Execute(program)
+
+		compiled := &VM{}
+		result := Compile(program).Execute(compiled, true)
+
+		if result != expected || compiled.PC != vm.PC || compiled.Accumulator != vm.Accumulator {
+			t.Fatalf("program %d: expected %v pc %d acc %d, got %v pc %d acc %d",
+				i, expected, vm.PC, vm.Accumulator, result, compiled.PC, compiled.Accumulator)
+		}
+	}
+}
+
+func TestBytecodeRegisters(t *testing.T) {
+	program, err := Assemble(strings.NewReader("set n 10\nloop: acc +2\nadd n -1\njnz n loop\nout acc\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := make(chan int, 1)
+	vm := &VM{Output: output}
+	if !Compile(program).Execute(vm, false) {
+		t.Fatalf("abnormal termination: %v", vm.Err)
+	}
+	if v := <-output; v != 20 {
+		t.Errorf("expected 20 got %d", v)
+	}
+
+	// The loop revisits instructions
+	vm = &VM{Output: output}
+	if Compile(program).Execute(vm, true) || vm.PC != 1 || vm.Accumulator != 2 {
+		t.Errorf("expected loop at 1 with acc 2, got pc %d acc %d", vm.PC, vm.Accumulator)
+	}
+
+	vm = &VM{}
+	if Compile(program).Execute(vm, false) || vm.Err == nil {
+		t.Error("expected error without output")
+	}
+}
+
+func TestBytecodeSnapshot(t *testing.T) {
+	program, err := Assemble(strings.NewReader("set n 1\nadd n -1\njnz n end\nacc +2\nend: nop +0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bc := Compile(program)
+
+	// Patching after compiling doesn't affect either kind of instruction
+	program.Instructions[1] = Instruction{Opcode: "nop"}
+	program.Instructions[3].Arg = 100
+
+	vm := &VM{}
+	if !bc.Execute(vm, true) {
+		t.Fatalf("abnormal termination: %v", vm.Err)
+	}
+	if vm.Accumulator != 2 {
+		t.Errorf("expected acc 2 got %d", vm.Accumulator)
+	}
+}
+
+// generateProgram returns a program of n instructions which runs every
+// one of them once, in a scrambled order, and then loops
+func generateProgram(rng *rand.Rand, n int) *Program {
+	order := rng.Perm(n - 1)
+	next := make([]int, n)
+	prev := 0
+	for _, addr := range order {
+		next[prev] = addr + 1
+		prev = addr + 1
+	}
+	next[prev] = 0
+
+	program := &Program{Instructions: make([]Instruction, n)}
+	for addr := range program.Instructions {
+		if next[addr] == addr+1 && rng.Intn(2) == 0 {
+			program.Instructions[addr] = Instruction{Opcode: "acc", Arg: rng.Intn(11) - 5}
+		} else {
+			program.Instructions[addr] = Instruction{Opcode: "jmp", Arg: next[addr] - addr}
+		}
+	}
+
+	return program
+}
+
+func BenchmarkExecute(b *testing.B) {
+	rng := rand.New(rand.NewSource(8))
+
+	for _, n := range []int{1000, 100000} {
+		program := generateProgram(rng, n)
+
+		b.Run(fmt.Sprintf("tracer-%d", n), func(b *testing.B) {
+			vm := &VM{}
+			tracer := &Tracer{Program: program}
+			vm.Breakpoint = tracer.Trace
+
+			for i := 0; i < b.N; i++ {
+				vm.Reset()
+				tracer.Reset()
+				vm.Execute(program)
+			}
+		})
+
+		b.Run(fmt.Sprintf("bytecode-%d", n), func(b *testing.B) {
+			vm := &VM{}
+			bc := Compile(program)
+
+			for i := 0; i < b.N; i++ {
+				vm.Reset()
+				bc.Execute(vm, true)
+			}
+		})
+	}
+}
+
+func recordTrace(t *testing.T, program *Program) string {
+	var sb strings.Builder
+
+	vm := &VM{}
+	recorder := NewTraceRecorder(&sb)
+	tracer := &Tracer{Program: program, Visited: make(map[int]bool)}
+	vm.Breakpoint = func(vm *VM, insn *Instruction) bool {
+		return tracer.Trace(vm, insn) || recorder.Record(vm, insn)
+	}
+
+	vm.Execute(program)
+	if err := recorder.Close(vm); err != nil {
+		t.Fatal(err)
+	}
+
+	return sb.String()
+}
+
+func TestTraceRecorder(t *testing.T) {
+	program, err := Assemble(strings.NewReader("acc +3\njmp +2\nacc +100\nacc -1\njmp -3\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"step":0,"pc":0,"insn":"acc +3","acc_before":0,"acc_after":3}
+{"step":1,"pc":1,"insn":"jmp +2","acc_before":3,"acc_after":3}
+{"step":2,"pc":3,"insn":"acc -1","acc_before":3,"acc_after":2}
+{"step":3,"pc":4,"insn":"jmp -3","acc_before":2,"acc_after":2}
+`
+	if got := recordTrace(t, program); got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+
+	// Nothing executed
+	if got := recordTrace(t, &Program{}); got != "" {
+		t.Errorf("expected empty trace, got %q", got)
+	}
+}
+
+func TestDiffTraces(t *testing.T) {
+	program := &Program{
+		Instructions: []Instruction{
+			{Opcode: "acc", Arg: 1},
+			{Opcode: "jmp", Arg: -1},
+			{Opcode: "acc", Arg: 5},
+		},
+	}
+	original := recordTrace(t, program)
+
+	d, err := DiffTraces(strings.NewReader(original), strings.NewReader(original))
+	if err != nil || d != nil {
+		t.Errorf("expected no divergence, got %v %v", d, err)
+	}
+
+	program.Instructions[1] = flipped(program.Instructions[1])
+	patched := recordTrace(t, program)
+
+	d, err = DiffTraces(strings.NewReader(original), strings.NewReader(patched))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d == nil || d.Step != 1 || d.Last == nil || d.Last.PC != 0 || d.A.Insn != "jmp -1" || d.B.Insn != "nop -1" {
+		t.Errorf("unexpected divergence: %+v", d)
+	}
+
+	// One trace is a prefix of the other
+	prefix := original[:strings.Index(original, "\n")+1]
+	d, err = DiffTraces(strings.NewReader(prefix), strings.NewReader(original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d == nil || d.Step != 1 || d.A != nil || d.B == nil {
+		t.Errorf("unexpected divergence: %+v", d)
+	}
+
+	var sb strings.Builder
+	d.WriteText(&sb)
+	if !strings.Contains(sb.String(), "< (end of trace)") {
+		t.Errorf("unexpected text:\n%s", sb.String())
+	}
+
+	if _, err := DiffTraces(strings.NewReader("{bad"), strings.NewReader(original)); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	vm := &VM{PC: 3, Accumulator: 7}
+	vm.SetReg("x", 1)
+
+	snapshot := vm.Snapshot()
+	vm.PC, vm.Accumulator = 10, 20
+	vm.SetReg("x", 2)
+	vm.Err = fmt.Errorf("failed")
+
+	for i := 0; i < 2; i++ {
+		if err := vm.Restore(snapshot); err != nil {
+			t.Fatal(err)
+		}
+		if vm.PC != 3 || vm.Accumulator != 7 || vm.Reg("x") != 1 || vm.Err != nil {
+			t.Errorf("restore %d: %#v", i, *vm)
+		}
+
+		// Changes after restoring mustn't affect the snapshot
+		vm.SetReg("x", 99)
+	}
+}
+
+func TestSnapshotWithTracer(t *testing.T) {
+	program, err := Assemble(strings.NewReader("acc +1\nacc +2\njmp -1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := &VM{}
+	tracer := &Tracer{Program: program, Visited: make(map[int]bool)}
+	vm.Breakpoint = tracer.Trace
+
+	// Stop before the second instruction
+	step := func() {
+		insn := program.Instructions[vm.PC]
+		tracer.Trace(vm, &insn)
+		insn.Execute(vm)
+	}
+	step()
+
+	snapshot := vm.SnapshotWith(tracer)
+
+	// Runs to the loop
+	if vm.Execute(program) || vm.PC != 1 || vm.Accumulator != 3 || len(tracer.Indices) != 3 {
+		t.Fatalf("unexpected state: pc %d acc %d traced %v", vm.PC, vm.Accumulator, tracer.Indices)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := vm.Restore(snapshot); err != nil {
+			t.Fatal(err)
+		}
+
+		if vm.PC != 1 || vm.Accumulator != 1 || len(tracer.Indices) != 1 || tracer.Visited[1] || tracer.Visited[2] {
+			t.Fatalf("restore %d: pc %d acc %d traced %v %v", i, vm.PC, vm.Accumulator, tracer.Indices, tracer.Visited)
+		}
+
+		// Execution picks up where the snapshot was taken
+		if vm.Execute(program) || vm.Accumulator != 3 {
+			t.Errorf("restore %d: expected acc 3 got %d", i, vm.Accumulator)
+		}
+	}
+
+	// The tracer has been reset since, so the snapshot is no longer valid
+	tracer.Reset()
+	if err := vm.Restore(snapshot); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestTracerRewind(t *testing.T) {
+	tracer := &Tracer{Visited: make(map[int]bool)}
+	vm := &VM{}
+
+	for _, pc := range []int{0, 4, 2} {
+		vm.PC = pc
+		tracer.Trace(vm, nil)
+	}
+
+	mark := tracer.Mark()
+	for _, pc := range []int{5, 1} {
+		vm.PC = pc
+		tracer.Trace(vm, nil)
+	}
+
+	if err := tracer.Rewind(mark); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tracer.Indices) != 3 || len(tracer.Visited) != 3 || tracer.Visited[5] || !tracer.Visited[2] {
+		t.Errorf("after rewind: %v %v", tracer.Indices, tracer.Visited)
+	}
+
+	if err := tracer.Rewind(10); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestWhatIfRepair(t *testing.T) {
+	rng := rand.New(rand.NewSource(46))
+
+	for i := 0; i < 1000; i++ {
+		program := randomProgram(rng, 5+rng.Intn(30))
+
+		// Only programs which loop need repairing
+		if terminatesWithFlip(program, -1) {
+			continue
+		}
+
+		fix, acc, err := WhatIfRepair(program)
+		expected, expectedErr := FindRepair(program)
+		_, oracleErr := BruteForceRepair(program)
+
+		if (err == nil) != (expectedErr == nil) || (err == nil) != (oracleErr == nil) {
+			t.Fatalf("%v: WhatIfRepair: %v, FindRepair: %v, brute force: %v", program.Instructions, err, expectedErr, oracleErr)
+		}
+		if err != nil {
+			continue
+		}
+
+		// Both find the first fix on the executed path
+		if fix != expected {
+			t.Fatalf("%v: expected fix %d got %d", program.Instructions, expected, fix)
+		}
+
+		program.Instructions[fix] = flipped(program.Instructions[fix])
+		vm := &VM{}
+		vm.Execute(program)
+		if vm.Accumulator != acc {
+			t.Fatalf("%v: expected acc %d got %d", program.Instructions, vm.Accumulator, acc)
+		}
+	}
+}
+
+func TestFindRepairTerminating(t *testing.T) {
+	// Already terminates. Flipping the nop makes it loop, but flipping the
+	// jmp still terminates.
+	program := &Program{
+		Instructions: []Instruction{
+			{Opcode: "nop", Arg: 0},
+			{Opcode: "jmp", Arg: 1},
+			{Opcode: "acc", Arg: 1},
+		},
+	}
+
+	fix, err := FindRepair(program)
+	if err != nil || fix != 1 {
+		t.Errorf("expected fix 1 got %d %v", fix, err)
+	}
+}
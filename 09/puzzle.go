@@ -2,30 +2,56 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 )
 
+// XMAS holds the window of the last preambleLen numbers received, as a
+// ring buffer and as a multiset of counts, so a number can be checked
+// against the window in O(window) rather than O(window²)
 type XMAS struct {
-	history []int
-	cursor  int
+	history  []int
+	cursor   int
+	received int
+	counts   map[int]int
 }
 
 func (x *XMAS) Receive(val int) {
+	if x.Ready() {
+		old := x.history[x.cursor]
+		x.counts[old]--
+		if x.counts[old] == 0 {
+			delete(x.counts, old)
+		}
+	}
+
 	x.history[x.cursor] = val
+	x.counts[val]++
+	x.received++
+
 	x.cursor++
 	if x.cursor >= len(x.history) {
 		x.cursor = 0
 	}
 }
 
+// Ready is true once the preamble has been received, and numbers can be
+// checked
+func (x *XMAS) Ready() bool {
+	return x.received >= len(x.history)
+}
+
+// Valid is true if val is the sum of two numbers in the window with
+// different values
 func (x *XMAS) Valid(val int) bool {
-	for i, v1 := range x.history {
-		for _, v2 := range x.history[i:] {
-			if v1+v2 == val {
-				return true
-			}
+	for _, v := range x.history {
+		if w := val - v; w != v && x.counts[w] > 0 {
+			return true
 		}
 	}
 	return false
@@ -34,70 +60,245 @@ func (x *XMAS) Valid(val int) bool {
 func NewXMAS(preambleLen int) *XMAS {
 	return &XMAS{
 		history: make([]int, preambleLen),
+		counts:  make(map[int]int, preambleLen),
 	}
 }
 
-func run() error {
-	if len(os.Args) != 2 {
-		return fmt.Errorf("Usage: %s INPUT", os.Args[0])
-	}
-
-	f, err := os.Open(os.Args[1])
-	if err != nil {
-		return err
-	}
-	defer f.Close()
+// Invalid is a number which isn't the sum of two in the window before it.
+// Index counts from 0, including the preamble.
+type Invalid struct {
+	Index int
+	Value int
+}
 
-	preambleLen := 25
+// Check reads numbers, one per line, calling report for each invalid one
+// as soon as it's read. It returns the whole message.
+func Check(r io.Reader, preambleLen int, report func(Invalid)) ([]int, error) {
 	x := NewXMAS(preambleLen)
-	i := 0
-	n := 0
-
 	message := make([]int, 0)
 
-	scanner := bufio.NewScanner(f)
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
-		line := scanner.Text()
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
 
-		n, err = strconv.Atoi(line)
+		n, err := strconv.Atoi(line)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		if i > preambleLen {
-			if !x.Valid(n) {
-				fmt.Println("Invalid:", n)
-				break
-			}
+		if x.Ready() && !x.Valid(n) {
+			report(Invalid{len(message), n})
 		}
+
 		x.Receive(n)
 		message = append(message, n)
-		i++
 	}
 
 	if err := scanner.Err(); err != nil {
-		return err
+		return nil, err
 	}
 
-	for i, v1 := range message {
-		sum := v1
-		min := v1
-		max := v1
-		for _, v2 := range message[i+1:] {
-			if v2 < min {
-				min = v2
-			}
-			if v2 > max {
-				max = v2
-			}
+	return message, nil
+}
+
+// Range is a contiguous run of the message, from Start to End inclusive
+type Range struct {
+	Start    int
+	End      int
+	Min      int
+	Max      int
+	Weakness int
+}
 
-			sum += v2
-			if sum == n {
-				fmt.Println("min, max, sum", min, max, min+max)
-			} else if sum > n {
-				break
+func newRange(message []int, start, end int) Range {
+	r := Range{Start: start, End: end, Min: message[start], Max: message[start]}
+	for _, v := range message[start+1 : end+1] {
+		if v < r.Min {
+			r.Min = v
+		}
+		if v > r.Max {
+			r.Max = v
+		}
+	}
+	r.Weakness = r.Min + r.Max
+
+	return r
+}
+
+// FindRanges returns every range of at least two numbers which sums to
+// target, ordered by Start then End
+func FindRanges(message []int, target int) []Range {
+	for _, v := range message {
+		if v < 0 {
+			return prefixSumRanges(message, target)
+		}
+	}
+
+	return twoPointerRanges(message, target)
+}
+
+// windowExtreme tracks the minimum (or maximum) of a sliding window. The
+// indices it holds increase, and their values increase (or decrease), so
+// the extreme of the window from any start is the first index at or after
+// that start.
+type windowExtreme struct {
+	message []int
+	better  func(a, b int) bool
+	indices []int
+	head    int
+}
+
+// push adds message[i] to the end of the window. Values it's better than
+// can never be the extreme again.
+func (w *windowExtreme) push(i int) {
+	for len(w.indices) > w.head && !w.better(w.message[w.indices[len(w.indices)-1]], w.message[i]) {
+		w.indices = w.indices[:len(w.indices)-1]
+	}
+	w.indices = append(w.indices, i)
+}
+
+// advance drops everything before start from the window
+func (w *windowExtreme) advance(start int) {
+	for w.indices[w.head] < start {
+		w.head++
+	}
+}
+
+// from returns the extreme of the window's values from start onwards
+func (w *windowExtreme) from(start int) int {
+	live := w.indices[w.head:]
+	k := sort.Search(len(live), func(k int) bool { return live[k] >= start })
+	return w.message[live[k]]
+}
+
+// twoPointerRanges finds ranges in a message with no negative numbers. As
+// the end of the range moves right, the smallest start whose sum doesn't
+// exceed target only ever moves right too, and the window's min and max
+// are kept in monotonic deques which move with it, so the search is O(n).
+//
+// Zeros mean several starts can work for the same end, but they're all
+// next to each other. The deques are searched for the min and max of the
+// ranges after the first, which costs O(log n) each.
+func twoPointerRanges(message []int, target int) []Range {
+	ranges := make([]Range, 0)
+
+	mins := &windowExtreme{message: message, better: func(a, b int) bool { return a < b }}
+	maxes := &windowExtreme{message: message, better: func(a, b int) bool { return a > b }}
+
+	start, sum := 0, 0
+	for end, v := range message {
+		sum += v
+		mins.push(end)
+		maxes.push(end)
+
+		for sum > target && start < end {
+			sum -= message[start]
+			start++
+		}
+		mins.advance(start)
+		maxes.advance(start)
+
+		for i, s := start, sum; i < end && s == target; i++ {
+			r := Range{Start: i, End: end}
+			if i == start {
+				r.Min = message[mins.indices[mins.head]]
+				r.Max = message[maxes.indices[maxes.head]]
+			} else {
+				r.Min = mins.from(i)
+				r.Max = maxes.from(i)
 			}
+			r.Weakness = r.Min + r.Max
+
+			ranges = append(ranges, r)
+			s -= message[i]
+		}
+	}
+
+	sortRanges(ranges)
+	return ranges
+}
+
+// prefixSumRanges works for any message. A range sums to target when the
+// prefix sums before its start and after its end differ by target, so
+// each end is matched against a map of earlier prefix sums. Unlike
+// twoPointerRanges, each range is scanned for its min and max, which adds
+// the combined length of the ranges to the cost.
+func prefixSumRanges(message []int, target int) []Range {
+	ranges := make([]Range, 0)
+
+	// The starts of ranges, keyed by the sum of everything before them
+	starts := make(map[int][]int)
+
+	sum := 0
+	for end, v := range message {
+		if end > 0 {
+			// The range must include at least end-1
+			starts[sum-message[end-1]] = append(starts[sum-message[end-1]], end-1)
+		}
+
+		sum += v
+		for _, start := range starts[sum-target] {
+			ranges = append(ranges, newRange(message, start, end))
+		}
+	}
+
+	sortRanges(ranges)
+	return ranges
+}
+
+func sortRanges(ranges []Range) {
+	sort.Slice(ranges, func(i, j int) bool {
+		if ranges[i].Start != ranges[j].Start {
+			return ranges[i].Start < ranges[j].Start
+		}
+		return ranges[i].End < ranges[j].End
+	})
+}
+
+func run() error {
+	preambleLen := flag.Int("preamble", 25, "number of values in the window")
+	flag.Parse()
+
+	if flag.NArg() > 1 || *preambleLen < 2 {
+		return fmt.Errorf("Usage: %s [--preamble N] [INPUT]", os.Args[0])
+	}
+
+	// Reads stdin if there's no INPUT, or it's "-"
+	in := os.Stdin
+	if flag.NArg() == 1 && flag.Arg(0) != "-" {
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			return err
 		}
+		defer f.Close()
+		in = f
+	}
+
+	invalid := make([]Invalid, 0)
+	message, err := Check(in, *preambleLen, func(inv Invalid) {
+		fmt.Printf("Invalid: %d at %d\n", inv.Value, inv.Index)
+		invalid = append(invalid, inv)
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(invalid) == 0 {
+		fmt.Println("No invalid numbers")
+		return nil
+	}
+
+	// The weakness is found using the first invalid number
+	ranges := FindRanges(message, invalid[0].Value)
+	if len(ranges) == 0 {
+		return fmt.Errorf("no range sums to %d", invalid[0].Value)
+	}
+
+	for _, r := range ranges {
+		fmt.Printf("Range %d-%d: min %d, max %d, weakness %d\n", r.Start, r.End, r.Min, r.Max, r.Weakness)
 	}
 
 	return nil
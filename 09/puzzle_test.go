@@ -1,6 +1,9 @@
 package main
 
 import (
+	"fmt"
+	"math/rand"
+	"strings"
 	"testing"
 )
 
@@ -22,3 +25,182 @@ func TestXMAS(t *testing.T) {
 		x.Receive(v)
 	}
 }
+
+func TestXMASWindow(t *testing.T) {
+	x := NewXMAS(3)
+
+	for _, v := range []int{5, 5, 1} {
+		if x.Ready() {
+			t.Errorf("ready before the preamble")
+		}
+		x.Receive(v)
+	}
+
+	if !x.Ready() {
+		t.Errorf("not ready after the preamble")
+	}
+
+	// The pair must have different values
+	if x.Valid(10) {
+		t.Errorf("10 reported as valid")
+	}
+	if !x.Valid(6) {
+		t.Errorf("6 reported as invalid")
+	}
+
+	// Evicts one 5, leaving one
+	x.Receive(2)
+	if !x.Valid(7) || !x.Valid(3) {
+		t.Errorf("7 or 3 reported as invalid")
+	}
+
+	// Evicts the other
+	x.Receive(9)
+	if x.Valid(6) || !x.Valid(11) {
+		t.Errorf("window not updated: %v", x.counts)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	seq := "35\n20\n15\n25\n47\n40\n62\n55\n65\n95\n102\n117\n150\n182\n127\n219\n299\n277\n309\n576\n1\n"
+
+	invalid := make([]Invalid, 0)
+	message, err := Check(strings.NewReader(seq), 5, func(inv Invalid) {
+		invalid = append(invalid, inv)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(message) != 21 {
+		t.Errorf("expected 21 numbers, got %d", len(message))
+	}
+
+	// Every invalid number is reported, not just the first
+	expected := []Invalid{{14, 127}, {20, 1}}
+	if len(invalid) != len(expected) {
+		t.Fatalf("expected %v got %v", expected, invalid)
+	}
+	for i := range expected {
+		if invalid[i] != expected[i] {
+			t.Errorf("expected %v got %v", expected[i], invalid[i])
+		}
+	}
+
+	// The first number after the preamble is checked
+	invalid = invalid[:0]
+	Check(strings.NewReader("1\n2\n4\n"), 2, func(inv Invalid) {
+		invalid = append(invalid, inv)
+	})
+	if len(invalid) != 1 || invalid[0] != (Invalid{2, 4}) {
+		t.Errorf("expected 4 at 2 got %v", invalid)
+	}
+
+	if _, err := Check(strings.NewReader("1\nx\n"), 2, func(Invalid) {}); err == nil {
+		t.Error("expected error")
+	}
+}
+
+// bruteForceRanges checks every range
+func bruteForceRanges(message []int, target int) []Range {
+	ranges := make([]Range, 0)
+	for start := range message {
+		sum := message[start]
+		for end := start + 1; end < len(message); end++ {
+			sum += message[end]
+			if sum == target {
+				ranges = append(ranges, newRange(message, start, end))
+			}
+		}
+	}
+
+	return ranges
+}
+
+func checkRanges(t *testing.T, message []int, target int, got, expected []Range) {
+	t.Helper()
+
+	if len(got) != len(expected) {
+		t.Fatalf("%v sum %d: expected %v got %v", message, target, expected, got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("%v sum %d: expected %v got %v", message, target, expected, got)
+		}
+	}
+}
+
+func TestFindRanges(t *testing.T) {
+	seq := []int{35, 20, 15, 25, 47, 40, 62, 55, 65, 95, 102, 117, 150, 182, 127, 219, 299, 277, 309, 576}
+
+	// The invalid number on its own isn't a range
+	checkRanges(t, seq, 127, FindRanges(seq, 127), []Range{{2, 5, 15, 47, 62}})
+
+	zeros := []int{0, 3, 0, 0, 3, 0}
+	checkRanges(t, zeros, 3, FindRanges(zeros, 3), bruteForceRanges(zeros, 3))
+	if len(FindRanges(zeros, 3)) != 10 {
+		t.Errorf("expected 10 ranges, got %v", FindRanges(zeros, 3))
+	}
+
+	negative := []int{5, -2, 4, 1, -3, 2}
+	checkRanges(t, negative, 3, FindRanges(negative, 3), []Range{
+		{0, 1, -2, 5, 3},
+		{1, 3, -2, 4, 2},
+	})
+}
+
+func TestFindRangesRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(9))
+
+	for i := 0; i < 500; i++ {
+		message := make([]int, rng.Intn(30))
+		for j := range message {
+			message[j] = rng.Intn(6)
+		}
+		target := rng.Intn(15)
+
+		expected := bruteForceRanges(message, target)
+		checkRanges(t, message, target, twoPointerRanges(message, target), expected)
+		checkRanges(t, message, target, prefixSumRanges(message, target), expected)
+
+		for j := range message {
+			message[j] -= 2
+		}
+		checkRanges(t, message, target-4, FindRanges(message, target-4), bruteForceRanges(message, target-4))
+	}
+}
+
+func TestFindRangesAllOnes(t *testing.T) {
+	const n, k = 100000, 1000
+
+	message := make([]int, n)
+	for i := range message {
+		message[i] = 1
+	}
+
+	ranges := twoPointerRanges(message, k)
+	if len(ranges) != n-k+1 {
+		t.Fatalf("expected %d ranges got %d", n-k+1, len(ranges))
+	}
+
+	for i, r := range ranges {
+		if r != (Range{i, i + k - 1, 1, 1, 2}) {
+			t.Fatalf("range %d: %v", i, r)
+		}
+	}
+}
+
+func BenchmarkTwoPointerRanges(b *testing.B) {
+	message := make([]int, 100000)
+	for i := range message {
+		message[i] = 1
+	}
+
+	for _, k := range []int{10, 1000, 10000} {
+		b.Run(fmt.Sprintf("ones-%d", k), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				twoPointerRanges(message, k)
+			}
+		})
+	}
+}
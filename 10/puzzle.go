@@ -2,145 +2,222 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
+	"io"
+	"math/big"
 	"os"
 	"sort"
 	"strconv"
+	"strings"
 )
 
-func run() error {
-	if len(os.Args) != 2 {
-		return fmt.Errorf("Usage: %s INPUT", os.Args[0])
+// Tolerance describes a device: the joltage steps its adapters accept,
+// and how far above the highest adapter its own input is
+type Tolerance struct {
+	MinGap       int
+	MaxGap       int
+	DeviceOffset int
+}
+
+func (t Tolerance) Validate() error {
+	if t.MinGap < 0 || t.MaxGap < 1 || t.MinGap > t.MaxGap {
+		return fmt.Errorf("invalid gaps: %d to %d", t.MinGap, t.MaxGap)
 	}
 
-	f, err := os.Open(os.Args[1])
-	if err != nil {
-		return err
+	if t.DeviceOffset < 0 {
+		return fmt.Errorf("invalid device offset: %d", t.DeviceOffset)
 	}
-	defer f.Close()
 
+	return nil
+}
+
+func (t Tolerance) Fits(gap int) bool {
+	return gap >= t.MinGap && gap <= t.MaxGap
+}
+
+// Chain returns the sorted joltages of the outlet (0), the adapters and
+// the device
+func (t Tolerance) Chain(adapters []int) []int {
+	chain := make([]int, 0, len(adapters)+2)
+	chain = append(chain, 0)
+	chain = append(chain, adapters...)
+	sort.Ints(chain)
+
+	return append(chain, chain[len(chain)-1]+t.DeviceOffset)
+}
+
+// Histogram counts the gaps between neighbours in the chain
+func Histogram(chain []int) map[int]int {
+	gaps := make(map[int]int)
+	for i := 1; i < len(chain); i++ {
+		gaps[chain[i]-chain[i-1]]++
+	}
+
+	return gaps
+}
+
+// Break is a gap between neighbours in the chain which the device can't
+// tolerate. Index is the position of Above in the chain.
+type Break struct {
+	Index int
+	Below int
+	Above int
+}
+
+func (b Break) Gap() int {
+	return b.Above - b.Below
+}
+
+// Breaks finds everywhere the chain, using every adapter, breaks
+func (t Tolerance) Breaks(chain []int) []Break {
+	breaks := make([]Break, 0)
+	for i := 1; i < len(chain); i++ {
+		if !t.Fits(chain[i] - chain[i-1]) {
+			breaks = append(breaks, Break{i, chain[i-1], chain[i]})
+		}
+	}
+
+	return breaks
+}
+
+// CountArrangements counts the ways of chaining from the first to the last
+// of the sorted joltages, using any subset of those in between, with every
+// step within the tolerance.
+//
+// Trying every subset isn't an option - like the puzzle page says, "there
+// must be more than a trillion valid ways". Instead, the number of ways to
+// reach each adapter is the sum of the ways to reach every adapter which
+// can connect directly to it, and the chain is sorted so they've all been
+// counted already. The counts grow exponentially with the number of
+// adapters, so they're big.Ints.
+func (t Tolerance) CountArrangements(chain []int) *big.Int {
+	if len(chain) == 0 {
+		return big.NewInt(0)
+	}
+
+	ways := make([]*big.Int, len(chain))
+	ways[0] = big.NewInt(1)
+
+	for i := 1; i < len(chain); i++ {
+		ways[i] = new(big.Int)
+		for j := i - 1; j >= 0 && chain[i]-chain[j] <= t.MaxGap; j-- {
+			if chain[i]-chain[j] >= t.MinGap {
+				ways[i].Add(ways[i], ways[j])
+			}
+		}
+	}
+
+	return ways[len(chain)-1]
+}
+
+func ReadAdapters(r io.Reader) ([]int, error) {
 	adapters := make([]int, 0)
 
-	scanner := bufio.NewScanner(f)
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
-		line := scanner.Text()
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
 
 		n, err := strconv.Atoi(line)
 		if err != nil {
-			return err
+			return nil, err
+		}
+
+		if n < 0 {
+			return nil, fmt.Errorf("negative joltage: %d", n)
 		}
 
 		adapters = append(adapters, n)
 	}
 
 	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return adapters, nil
+}
+
+// describe names a joltage in the chain
+func describe(chain []int, i int) string {
+	switch i {
+	case 0:
+		return "outlet (0)"
+	case len(chain) - 1:
+		return fmt.Sprintf("device (%d)", chain[i])
+	}
+
+	return fmt.Sprintf("adapter %d", chain[i])
+}
+
+// diagnose reports everywhere the chain breaks, and whether some subset of
+// the adapters still works
+func diagnose(t Tolerance, chain []int) {
+	breaks := t.Breaks(chain)
+	for _, b := range breaks {
+		fmt.Printf("Break: %s -> %s, gap %d\n", describe(chain, b.Index-1), describe(chain, b.Index), b.Gap())
+	}
+
+	fmt.Printf("%d breaks using every adapter\n", len(breaks))
+	fmt.Println("Arrangements using some adapters:", t.CountArrangements(chain))
+}
+
+func run() error {
+	t := Tolerance{}
+	flag.IntVar(&t.MinGap, "min-gap", 1, "smallest joltage step an adapter accepts")
+	flag.IntVar(&t.MaxGap, "max-gap", 3, "largest joltage step an adapter accepts")
+	flag.IntVar(&t.DeviceOffset, "device-offset", 3, "device joltage above the highest adapter")
+	flag.Parse()
+
+	if flag.NArg() < 1 || flag.NArg() > 2 || (flag.NArg() == 2 && flag.Arg(1) != "diagnose") {
+		return fmt.Errorf("Usage: %s [OPTIONS] INPUT [diagnose]", os.Args[0])
+	}
+
+	if err := t.Validate(); err != nil {
+		return err
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	adapters, err := ReadAdapters(f)
+	if err != nil {
 		return err
 	}
 
 	fmt.Println("I have", len(adapters), "adapters")
 
-	// Add outlet at 0 Jolts
-	adapters = append(adapters, 0)
-	sort.Ints(adapters)
-
-	numOneJolt := 0
-	numThreeJolt := 0
-	currentJolts := 0
-	deviceJolts := adapters[len(adapters)-1] + 3
-	adapters = append(adapters, deviceJolts)
-
-	for _, a := range adapters[1:] {
-		switch a - currentJolts {
-		case 1:
-			numOneJolt++
-		case 3:
-			numThreeJolt++
-		default:
-			return fmt.Errorf("unexpected difference: %d - %d = %d", a, currentJolts, a-currentJolts)
-		}
-		currentJolts = a
-	}
-
-	fmt.Println("One Jolts:", numOneJolt, ", Three Jolts:", numThreeJolt, ", Product:", numOneJolt*numThreeJolt)
-
-	// The general solution would be to recurisvely remove adapters and see
-	// if the result is still valid, and explore the solution space that
-	// way, but like the puzzle page says "there must be more than a
-	// trillion valid ways", so I assume that's not a good idea (and that
-	// sounds like a hint not to go for a recursive solution).
-	//
-	// So instead, let's look for adapters that can be removed in isolation
-	// and still leave a valid configuration. Then we can treat groups of
-	// those "removable" adapters as places where the chain can be broken.
-	// Depending on the number of adapters in the group, there are a
-	// different number of ways to remove some or all of those adapters
-	// while maintaining a valid chain:
-	//
-	// Group of 1
-	// ----------
-	// For example with the sequence 26, 27, 28, 31 we can only remove 27.
-	// If we remove 28, then that leaves 26, 27, __, 31 - which is a gap of
-	// 4 which is invalid. That's a "group" of 1: We can only remove one
-	// adapter. This represents TWO ways to make a valid configuration:
-	//  1. Adapter 27 present
-	//  2. Adapter 27 absent
-	//
-	// Group of 2
-	// ----------
-	// If we have 0, 1, 2, 3, 6, then we can remove 1, 2, or both and still
-	// be left with valid configurations - a "group" of 2, with FOUR
-	// possible configurations:
-	//  1. 0, 1, 2, 3
-	//  2. 0, _, 2, 3
-	//  3. 0, 1, _, 3
-	//  4. 0, _, _, 3
-	//
-	// Group of 3
-	// ----------
-	// 33, 36, 37, 38, 39, 40, 43 is a group of three. We can remove any of
-	// 37, 38, 39, but not all three at once. This is a group of 3 and
-	// represents SEVEN valid configurations (note it's not 8, because the
-	// "all three absent" configuration is not valid.
-	//
-	// So to find the total number of valid configurations, we find all the
-	// "groups", and multiply together all the combinations represented by
-	// that "group" (1, 4, or 7)
-	// That requires a single traversal of the list, so it's only O(N)
-
-	numCombinations := 1
-	numInGroup := 0
-	for i := 1; i < len(adapters)-1; i++ {
-		prev := adapters[i-1]
-		current := adapters[i]
-		next := adapters[i+1]
-
-		if (next - prev) >= 1 && (next - prev) <= 3 {
-			// Still valid, keep adding to the group
-			numInGroup++
-			fmt.Printf("--> %3d [%3d] %3d valid\n", prev, current, next)
-		} else {
-			// Invalid, so evaluate the group
-			switch numInGroup {
-			case 0:
-				break
-			case 1:
-				numCombinations *= 2
-			case 2:
-				numCombinations *= 4
-			case 3:
-				numCombinations *= 7
-			default:
-				return fmt.Errorf("group size too large: %d", numInGroup)
-			}
+	chain := t.Chain(adapters)
 
-			fmt.Printf("--X %3d [%3d] %3d invalid. Block of %d\n", prev, current, next, numInGroup)
+	if flag.NArg() == 2 {
+		diagnose(t, chain)
+		return nil
+	}
 
-			// Reset the group
-			numInGroup = 0
-		}
+	hist := Histogram(chain)
+	gaps := make([]int, 0, len(hist))
+	for gap := range hist {
+		gaps = append(gaps, gap)
 	}
+	sort.Ints(gaps)
+
+	for _, gap := range gaps {
+		fmt.Printf("Gap %d: %d\n", gap, hist[gap])
+	}
+
+	if breaks := t.Breaks(chain); len(breaks) > 0 {
+		b := breaks[0]
+		return fmt.Errorf("chain breaks in %d places, first between %d and %d (try diagnose)", len(breaks), b.Below, b.Above)
+	}
+
+	fmt.Println("One Jolts:", hist[1], ", Three Jolts:", hist[3], ", Product:", hist[1]*hist[3])
 
-	fmt.Println("Number of combinations:", numCombinations)
+	fmt.Println("Number of combinations:", t.CountArrangements(chain))
 
 	return nil
 }
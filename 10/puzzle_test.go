@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+var defaultTolerance = Tolerance{MinGap: 1, MaxGap: 3, DeviceOffset: 3}
+
+func readAdapters(t *testing.T, src string) []int {
+	adapters, err := ReadAdapters(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return adapters
+}
+
+const example1 = "16\n10\n15\n5\n1\n11\n7\n19\n6\n12\n4\n"
+
+const example2 = `28
+33
+18
+42
+31
+14
+46
+20
+48
+47
+24
+23
+49
+45
+19
+38
+39
+11
+1
+32
+25
+35
+8
+17
+7
+9
+4
+2
+34
+10
+3
+`
+
+func TestCountArrangements(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected int64
+	}{
+		{example1, 8},
+		{example2, 19208},
+
+		// 2-jolt gaps
+		{"2\n4\n6\n8\n", 1},
+		{"1\n3\n4\n6\n", 5},
+		{"2\n3\n5\n", 3},
+
+		// A run of 6 removable adapters
+		{"1\n2\n3\n4\n5\n6\n7\n", 44},
+	}
+
+	for _, test := range tests {
+		chain := defaultTolerance.Chain(readAdapters(t, test.src))
+		count := defaultTolerance.CountArrangements(chain)
+		if count.Cmp(big.NewInt(test.expected)) != 0 {
+			t.Errorf("%q: expected %d got %v", test.src, test.expected, count)
+		}
+	}
+}
+
+func TestCountArrangementsBig(t *testing.T) {
+	adapters := make([]int, 100)
+	for i := range adapters {
+		adapters[i] = i + 1
+	}
+
+	// Tribonacci(100), well beyond an int64
+	expected, ok := new(big.Int).SetString("180396380815100901214157639", 10)
+	if !ok {
+		t.Fatal("bad constant")
+	}
+
+	count := defaultTolerance.CountArrangements(defaultTolerance.Chain(adapters))
+	if count.Cmp(expected) != 0 {
+		t.Errorf("expected %v got %v", expected, count)
+	}
+
+	if count.IsInt64() {
+		t.Errorf("%v should overflow int64", count)
+	}
+}
+
+// bruteForceArrangements tries every subset of the adapters
+func bruteForceArrangements(tol Tolerance, chain []int) int64 {
+	inner := chain[1 : len(chain)-1]
+
+	count := int64(0)
+	for mask := 0; mask < 1<<len(inner); mask++ {
+		prev := chain[0]
+		ok := true
+		for i, j := range inner {
+			if mask&(1<<i) == 0 {
+				continue
+			}
+			if !tol.Fits(j - prev) {
+				ok = false
+				break
+			}
+			prev = j
+		}
+
+		if ok && tol.Fits(chain[len(chain)-1]-prev) {
+			count++
+		}
+	}
+
+	return count
+}
+
+func TestTolerance(t *testing.T) {
+	tests := []struct {
+		name     string
+		tol      Tolerance
+		src      string
+		chain    []int
+		hist     map[int]int
+		breaks   []Break
+		expected int64
+	}{
+		{
+			name:     "default",
+			tol:      defaultTolerance,
+			src:      "1\n2\n5\n",
+			chain:    []int{0, 1, 2, 5, 8},
+			hist:     map[int]int{1: 2, 3: 2},
+			breaks:   []Break{},
+			expected: 2,
+		},
+		{
+			name:     "duplicates not allowed",
+			tol:      defaultTolerance,
+			src:      "1\n1\n2\n",
+			chain:    []int{0, 1, 1, 2, 5},
+			hist:     map[int]int{0: 1, 1: 2, 3: 1},
+			breaks:   []Break{{2, 1, 1}},
+			expected: 3,
+		},
+		{
+			name:     "min gap 0 allows duplicates",
+			tol:      Tolerance{MinGap: 0, MaxGap: 3, DeviceOffset: 3},
+			src:      "1\n1\n2\n",
+			chain:    []int{0, 1, 1, 2, 5},
+			hist:     map[int]int{0: 1, 1: 2, 3: 1},
+			breaks:   []Break{},
+			expected: 4,
+		},
+		{
+			name:     "max gap 2",
+			tol:      Tolerance{MinGap: 1, MaxGap: 2, DeviceOffset: 2},
+			src:      "1\n2\n3\n5\n",
+			chain:    []int{0, 1, 2, 3, 5, 7},
+			hist:     map[int]int{1: 3, 2: 2},
+			breaks:   []Break{},
+			expected: 3,
+		},
+		{
+			name:     "min gap 2",
+			tol:      Tolerance{MinGap: 2, MaxGap: 4, DeviceOffset: 4},
+			src:      "1\n2\n4\n6\n",
+			chain:    []int{0, 1, 2, 4, 6, 10},
+			hist:     map[int]int{1: 2, 2: 2, 4: 1},
+			breaks:   []Break{{1, 0, 1}, {2, 1, 2}},
+			expected: 3,
+		},
+		{
+			name:     "device offset 1",
+			tol:      Tolerance{MinGap: 1, MaxGap: 3, DeviceOffset: 1},
+			src:      "1\n2\n",
+			chain:    []int{0, 1, 2, 3},
+			hist:     map[int]int{1: 3},
+			breaks:   []Break{},
+			expected: 4,
+		},
+		{
+			name:     "device offset too big",
+			tol:      Tolerance{MinGap: 1, MaxGap: 3, DeviceOffset: 5},
+			src:      "1\n2\n",
+			chain:    []int{0, 1, 2, 7},
+			hist:     map[int]int{1: 2, 5: 1},
+			breaks:   []Break{{3, 2, 7}},
+			expected: 0,
+		},
+		{
+			name:     "broken twice",
+			tol:      defaultTolerance,
+			src:      "1\n5\n6\n10\n",
+			chain:    []int{0, 1, 5, 6, 10, 13},
+			hist:     map[int]int{1: 2, 3: 1, 4: 2},
+			breaks:   []Break{{2, 1, 5}, {4, 6, 10}},
+			expected: 0,
+		},
+	}
+
+	for _, test := range tests {
+		if err := test.tol.Validate(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		chain := test.tol.Chain(readAdapters(t, test.src))
+		if len(chain) != len(test.chain) {
+			t.Fatalf("%s: expected chain %v got %v", test.name, test.chain, chain)
+		}
+		for i := range chain {
+			if chain[i] != test.chain[i] {
+				t.Fatalf("%s: expected chain %v got %v", test.name, test.chain, chain)
+			}
+		}
+
+		hist := Histogram(chain)
+		if len(hist) != len(test.hist) {
+			t.Errorf("%s: expected histogram %v got %v", test.name, test.hist, hist)
+		}
+		for gap, n := range test.hist {
+			if hist[gap] != n {
+				t.Errorf("%s: expected histogram %v got %v", test.name, test.hist, hist)
+			}
+		}
+
+		breaks := test.tol.Breaks(chain)
+		if len(breaks) != len(test.breaks) {
+			t.Errorf("%s: expected breaks %v got %v", test.name, test.breaks, breaks)
+		} else {
+			for i := range breaks {
+				if breaks[i] != test.breaks[i] {
+					t.Errorf("%s: expected breaks %v got %v", test.name, test.breaks, breaks)
+				}
+			}
+		}
+
+		count := test.tol.CountArrangements(chain)
+		if count.Cmp(big.NewInt(test.expected)) != 0 {
+			t.Errorf("%s: expected %d arrangements got %v", test.name, test.expected, count)
+		}
+		if brute := bruteForceArrangements(test.tol, chain); brute != test.expected {
+			t.Errorf("%s: brute force found %d arrangements, expected %d", test.name, brute, test.expected)
+		}
+	}
+}
+
+func TestBreakDescription(t *testing.T) {
+	chain := defaultTolerance.Chain([]int{1, 5, 6, 20})
+	breaks := defaultTolerance.Breaks(chain)
+
+	expected := []string{
+		"adapter 1 -> adapter 5, gap 4",
+		"adapter 6 -> adapter 20, gap 14",
+	}
+	if len(breaks) != len(expected) {
+		t.Fatalf("expected %d breaks got %v", len(expected), breaks)
+	}
+
+	for i, b := range breaks {
+		got := fmt.Sprintf("%s -> %s, gap %d", describe(chain, b.Index-1), describe(chain, b.Index), b.Gap())
+		if got != expected[i] {
+			t.Errorf("expected %q got %q", expected[i], got)
+		}
+	}
+
+	if describe(chain, 0) != "outlet (0)" || describe(chain, len(chain)-1) != "device (23)" {
+		t.Errorf("unexpected ends: %s, %s", describe(chain, 0), describe(chain, len(chain)-1))
+	}
+}
+
+func TestToleranceValidate(t *testing.T) {
+	bad := []Tolerance{
+		{MinGap: -1, MaxGap: 3},
+		{MinGap: 0, MaxGap: 0},
+		{MinGap: 3, MaxGap: 2},
+		{MinGap: 1, MaxGap: 3, DeviceOffset: -1},
+	}
+
+	for _, tol := range bad {
+		if err := tol.Validate(); err == nil {
+			t.Errorf("%+v: expected error", tol)
+		}
+	}
+}